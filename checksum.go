@@ -0,0 +1,311 @@
+package warplib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+type ChecksumAlgorithm string
+
+const (
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumSHA1   ChecksumAlgorithm = "sha1"
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+func (a ChecksumAlgorithm) new() (h hash.Hash, err error) {
+	switch a {
+	case ChecksumSHA256:
+		h = sha256.New()
+	case ChecksumSHA1:
+		h = sha1.New()
+	case ChecksumMD5:
+		h = md5.New()
+	case ChecksumCRC32C:
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		err = fmt.Errorf("%w: %s", ErrChecksumNotSupported, a)
+	}
+	return
+}
+
+func (a ChecksumAlgorithm) size() int {
+	switch a {
+	case ChecksumSHA256:
+		return sha256.Size
+	case ChecksumSHA1:
+		return sha1.Size
+	case ChecksumMD5:
+		return md5.Size
+	case ChecksumCRC32C:
+		return crc32.Size
+	}
+	return 0
+}
+
+// digestAlgorithms maps the algorithm names used by digest
+// headers to checksum algorithms.
+var digestAlgorithms = map[string]ChecksumAlgorithm{
+	"sha-256": ChecksumSHA256,
+	"sha":     ChecksumSHA1,
+	"sha-1":   ChecksumSHA1,
+	"md5":     ChecksumMD5,
+	"crc32c":  ChecksumCRC32C,
+}
+
+// Checksum is an expected digest of the downloaded file.
+type Checksum struct {
+	Algorithm ChecksumAlgorithm
+	// Digest is the hex encoded digest.
+	Digest string
+}
+
+// newChecksum returns the checksum for a base64 encoded digest
+// sent by the server with the named algorithm, it reports
+// false if the algorithm isn't supported or the digest is
+// malformed.
+func newChecksum(name, digest string) (sum Checksum, ok bool) {
+	algo, ok := digestAlgorithms[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(digest))
+	if err != nil || len(b) != algo.size() {
+		ok = false
+		return
+	}
+	sum = Checksum{algo, hex.EncodeToString(b)}
+	return
+}
+
+// parseChecksums returns the checksums found in the Digest,
+// Repr-Digest, Content-Digest, Content-MD5 and x-goog-hash
+// headers of a response to a request for the whole file.
+func parseChecksums(h http.Header) (sums []Checksum) {
+	add := func(name, digest string) {
+		sum, ok := newChecksum(name, digest)
+		if ok && !hasChecksum(sums, sum.Algorithm) {
+			sums = append(sums, sum)
+		}
+	}
+	// Digest: SHA-256=<base64>, MD5=<base64>
+	// x-goog-hash: crc32c=<base64>, md5=<base64>
+	for _, key := range []string{"Digest", "X-Goog-Hash"} {
+		for _, v := range h.Values(key) {
+			for _, e := range strings.Split(v, ",") {
+				name, digest, _ := strings.Cut(e, "=")
+				add(name, digest)
+			}
+		}
+	}
+	// Repr-Digest: sha-256=:<base64>:
+	for _, key := range []string{"Repr-Digest", "Content-Digest"} {
+		for _, v := range h.Values(key) {
+			for _, e := range strings.Split(v, ",") {
+				name, digest, _ := strings.Cut(e, "=")
+				digest, _, _ = strings.Cut(digest, ";")
+				add(name, strings.Trim(strings.TrimSpace(digest), ":"))
+			}
+		}
+	}
+	if v := h.Get("Content-MD5"); v != "" {
+		add("md5", v)
+	}
+	return
+}
+
+func hasChecksum(sums []Checksum, algo ChecksumAlgorithm) bool {
+	for _, sum := range sums {
+		if sum.Algorithm == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// ChecksumError is returned when the digest of the downloaded
+// file doesn't match the expected one.
+type ChecksumError struct {
+	Algorithm ChecksumAlgorithm
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf(
+		"%s checksum mismatch: expected %s, got %s",
+		e.Algorithm, e.Expected, e.Actual,
+	)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// digester computes digests of the download file as it gets
+// written. Bytes written in order are digested right away, other
+// written regions are read back from the file in the background
+// once they become contiguous with the bytes digested so far.
+type digester struct {
+	sums []Checksum
+	hs   []hash.Hash
+	w    io.Writer
+	f    *os.File
+	mu   sync.Mutex
+	wg   sync.WaitGroup
+	// number of bytes digested
+	off int64
+	// written regions yet to be digested, mapped by their
+	// initial offsets to final offsets.
+	pending map[int64]int64
+	running bool
+	err     error
+}
+
+// newDigester returns a digester for sums, it returns nil if
+// there is nothing to verify.
+func newDigester(sums []Checksum) (g *digester, err error) {
+	if len(sums) == 0 {
+		return
+	}
+	g = &digester{
+		sums:    sums,
+		hs:      make([]hash.Hash, len(sums)),
+		pending: make(map[int64]int64),
+	}
+	ws := make([]io.Writer, len(sums))
+	for i, sum := range sums {
+		g.hs[i], err = sum.Algorithm.new()
+		if err != nil {
+			return nil, err
+		}
+		ws[i] = g.hs[i]
+	}
+	g.w = io.MultiWriter(ws...)
+	return
+}
+
+// setFile sets the file regions are digested from.
+func (g *digester) setFile(f *os.File) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.f = f
+}
+
+// feed digests b, downloaded for offset off of the file, if it
+// directly follows the bytes digested so far. Bytes it skips are
+// read back from the file once their region is written.
+func (g *digester) feed(off int64, b []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running || g.err != nil || off != g.off {
+		return
+	}
+	g.w.Write(b)
+	g.off += int64(len(b))
+}
+
+// written marks bytes from ioff till foff of the file as
+// written.
+func (g *digester) written(ioff, foff int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending[ioff] = foff
+	if g.running {
+		return
+	}
+	g.running = true
+	g.wg.Add(1)
+	go g.run()
+}
+
+// run digests pending regions as long as they are contiguous
+// with the digested bytes.
+func (g *digester) run() {
+	defer g.wg.Done()
+	for {
+		g.mu.Lock()
+		foff, ok := g.next()
+		if !ok || g.err != nil {
+			g.running = false
+			g.mu.Unlock()
+			return
+		}
+		ioff := g.off
+		g.mu.Unlock()
+
+		err := g.digest(ioff, foff+1)
+		g.mu.Lock()
+		g.err = err
+		g.mu.Unlock()
+	}
+}
+
+// next takes the final offset of the pending region holding the
+// first byte yet to be digested, dropping the regions which were
+// already fed. The digester has to be locked.
+func (g *digester) next() (foff int64, ok bool) {
+	for ioff, foff := range g.pending {
+		if foff < g.off {
+			delete(g.pending, ioff)
+			continue
+		}
+		if ioff <= g.off {
+			delete(g.pending, ioff)
+			return foff, true
+		}
+	}
+	return
+}
+
+func (g *digester) digest(ioff, end int64) (err error) {
+	n, err := io.Copy(g.w, io.NewSectionReader(g.f, ioff, end-ioff))
+	g.mu.Lock()
+	g.off = ioff + n
+	g.mu.Unlock()
+	if err == nil && ioff+n != end {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// verify digests the bytes of the file which haven't been
+// digested yet, up to size, and compares every digest with
+// the expected one. The callback is called for each checksum
+// with the result of its comparison.
+func (g *digester) verify(size int64, callback func(Checksum, error)) (err error) {
+	g.wg.Wait()
+	if g.err != nil {
+		return g.err
+	}
+	if g.off < size {
+		err = g.digest(g.off, size)
+		if err != nil {
+			return
+		}
+	}
+	for i, sum := range g.sums {
+		actual := hex.EncodeToString(g.hs[i].Sum(nil))
+		var er error
+		if !strings.EqualFold(actual, sum.Digest) {
+			er = &ChecksumError{sum.Algorithm, sum.Digest, actual}
+		}
+		callback(sum, er)
+		if er != nil && err == nil {
+			err = er
+		}
+	}
+	return
+}
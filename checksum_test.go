@@ -0,0 +1,142 @@
+package warplib
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_digester(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	sum := md5.Sum(data)
+	digest := hex.EncodeToString(sum[:])
+	tests := []struct {
+		name    string
+		digest  string
+		regions [][2]int64
+		wantErr error
+	}{
+		{"no regions", digest, nil, nil},
+		{"in order", digest, [][2]int64{{0, 9}, {10, 19}, {20, 42}}, nil},
+		{"out of order", digest, [][2]int64{{20, 42}, {0, 9}, {10, 19}}, nil},
+		{"partially written", digest, [][2]int64{{10, 19}}, nil},
+		{"mismatch", "00" + digest[2:], [][2]int64{{0, 42}}, ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fName := filepath.Join(t.TempDir(), "warp.dl")
+			if err := os.WriteFile(fName, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			f, err := os.Open(fName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			g, err := newDigester([]Checksum{{ChecksumMD5, tt.digest}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.setFile(f)
+			for _, r := range tt.regions {
+				g.written(r[0], r[1])
+			}
+			var calls int
+			err = g.verify(int64(len(data)), func(Checksum, error) { calls++ })
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("digester.verify() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != 1 {
+				t.Errorf("digester.verify() called back %d times, want 1", calls)
+			}
+		})
+	}
+}
+
+func Test_digester_feed(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	sum := md5.Sum(data)
+	// the fed bytes are zeroed in the file so that reading
+	// them back breaks the digest.
+	fName := filepath.Join(t.TempDir(), "warp.dl")
+	file := append(make([]byte, 20), data[20:]...)
+	if err := os.WriteFile(fName, file, 0666); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := newDigester([]Checksum{{ChecksumMD5, hex.EncodeToString(sum[:])}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.setFile(f)
+	g.feed(0, data[:10])
+	g.feed(30, data[30:])
+	g.feed(10, data[10:20])
+	g.written(0, 9)
+	g.written(10, 19)
+	g.written(20, 42)
+	err = g.verify(int64(len(data)), func(Checksum, error) {})
+	if err != nil {
+		t.Errorf("digester.verify() error = %v, want nil", err)
+	}
+}
+
+func Test_parseChecksums(t *testing.T) {
+	// digests of "hello"
+	const (
+		md5B64    = "XUFAKrxLKna5cZ2REBfFkg=="
+		md5Hex    = "5d41402abc4b2a76b9719d911017c592"
+		sha256B64 = "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+		sha256Hex = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		crcB64    = "mnG7TA=="
+		crcHex    = "9a71bb4c"
+	)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []Checksum
+	}{
+		{"no digests", http.Header{}, nil},
+		{
+			"digest",
+			http.Header{"Digest": {"SHA-256=" + sha256B64 + ", MD5=" + md5B64}},
+			[]Checksum{{ChecksumSHA256, sha256Hex}, {ChecksumMD5, md5Hex}},
+		},
+		{
+			"repr digest",
+			http.Header{"Repr-Digest": {"sha-256=:" + sha256B64 + ":, sha-512=:AAAA:"}},
+			[]Checksum{{ChecksumSHA256, sha256Hex}},
+		},
+		{
+			"content md5",
+			http.Header{"Content-Md5": {md5B64}},
+			[]Checksum{{ChecksumMD5, md5Hex}},
+		},
+		{
+			"x-goog-hash",
+			http.Header{"X-Goog-Hash": {"crc32c=" + crcB64, "md5=" + md5B64}},
+			[]Checksum{{ChecksumCRC32C, crcHex}, {ChecksumMD5, md5Hex}},
+		},
+		{
+			"malformed digest",
+			http.Header{"Digest": {"SHA-256=bm90IGEgZGlnZXN0"}},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseChecksums(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChecksums() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
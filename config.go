@@ -0,0 +1,71 @@
+package warplib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Config sets the directories used by the manager and the
+// downloaders. Directories are created once they're needed.
+type Config struct {
+	// ConfigDir holds the database of the manager, it's the
+	// warp directory in the user config directory by default.
+	ConfigDir string
+	// DataDir holds the data of the downloads in progress,
+	// it's the dldata directory in ConfigDir by default.
+	DataDir string
+	// LogDir holds the logs of the downloads, which are kept
+	// with the data of the downloads and removed along with it
+	// if LogDir is empty.
+	LogDir string
+}
+
+// DefaultConfig returns the config of the default directories.
+func DefaultConfig() (*Config, error) {
+	cfg := &Config{}
+	return cfg, cfg.setDefault()
+}
+
+// setDefault fills the empty directories of the config.
+func (c *Config) setDefault() error {
+	if c.ConfigDir == "" {
+		cdr, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		c.ConfigDir = filepath.Join(cdr, "warp")
+	}
+	if c.DataDir == "" {
+		c.DataDir = filepath.Join(c.ConfigDir, "dldata")
+	}
+	return nil
+}
+
+// resolveConfig returns the config with its empty directories
+// filled, cfg may be nil for the default config.
+func resolveConfig(cfg *Config) (*Config, error) {
+	if cfg == nil {
+		return DefaultConfig()
+	}
+	c := *cfg
+	return &c, c.setDefault()
+}
+
+func (c *Config) userdataPath() string {
+	return filepath.Join(c.ConfigDir, "userdata.warp")
+}
+
+// dataPath returns the directory holding the data of the
+// download with hash.
+func (c *Config) dataPath(hash string) string {
+	return fmt.Sprintf("%s/%s/", c.DataDir, hash)
+}
+
+// logPath returns the log file of the download with hash.
+func (c *Config) logPath(hash string) string {
+	if c.LogDir == "" {
+		return c.dataPath(hash) + "logs.txt"
+	}
+	return filepath.Join(c.LogDir, hash+".log")
+}
@@ -0,0 +1,93 @@
+package warplib
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func Test_resolveConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         *Config
+		wantDataDir string
+		wantLog     string
+	}{
+		{
+			"config dir only",
+			&Config{ConfigDir: "/srv/warp"},
+			"/srv/warp/dldata",
+			"/srv/warp/dldata/abcd/logs.txt",
+		},
+		{
+			"all directories",
+			&Config{ConfigDir: "/srv/warp", DataDir: "/data", LogDir: "/var/log/warp"},
+			"/data",
+			filepath.Join("/var/log/warp", "abcd.log"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := *tt.cfg
+			cfg, err := resolveConfig(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.DataDir != tt.wantDataDir {
+				t.Errorf("DataDir = %q, want %q", cfg.DataDir, tt.wantDataDir)
+			}
+			if got := cfg.logPath("abcd"); got != tt.wantLog {
+				t.Errorf("logPath() = %q, want %q", got, tt.wantLog)
+			}
+			if *tt.cfg != orig {
+				t.Errorf("resolveConfig() modified the passed config")
+			}
+		})
+	}
+}
+
+func TestManager_AddDownload_config(t *testing.T) {
+	srv := newRangeServer(t, bytes.Repeat([]byte("warp"), 1024), 0)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	for _, tt := range []struct {
+		name string
+		cfg  *Config
+		want error
+	}{
+		{"same config", &Config{ConfigDir: cfg.ConfigDir}, nil},
+		{"other data dir", &Config{ConfigDir: cfg.ConfigDir, DataDir: t.TempDir()}, ErrConfigMismatch},
+		{"other config dir", &Config{ConfigDir: t.TempDir()}, ErrConfigMismatch},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+				Config:            tt.cfg,
+				DownloadDirectory: t.TempDir(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.AddDownload(d, nil); !errors.Is(err, tt.want) {
+				t.Errorf("AddDownload() error = %v, want %v", err, tt.want)
+			}
+			if added := m.GetItem(d.hash) != nil; added != (tt.want == nil) {
+				t.Errorf("item added = %v, want %v", added, tt.want == nil)
+			}
+		})
+	}
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		SkipSetup: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); !errors.Is(err, ErrDownloadNotSetUp) {
+		t.Errorf("AddDownload() of download skipping setup error = %v, want %v", err, ErrDownloadNotSetUp)
+	}
+}
@@ -0,0 +1,181 @@
+package warplib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// Layout of the manager database file:
+//
+//	magic   [6]byte  "WARPDB"
+//	version uint32   schema version of the items
+//	length  uint64   length of the payload
+//	crc     uint32   CRC-32 (IEEE) of the payload
+//	payload []byte   gob encoded ItemsMap
+//
+// Files written before the header was introduced consist of
+// the payload alone and are read as version 0.
+const (
+	_DB_MAGIC       = "WARPDB"
+	_DB_HEADER_SIZE = len(_DB_MAGIC) + 4 + 8 + 4
+	// _DB_VERSION is the current schema version, dbMigrations
+	// must have an entry for every older version.
+	_DB_VERSION = 1
+)
+
+// dbMigrations upgrade the items of version i to version i+1.
+var dbMigrations = []func(items ItemsMap){
+	// items got lifecycle states and downloads are staged in
+	// the data directory.
+	func(items ItemsMap) {
+		for _, item := range items {
+			item.migrateStaging()
+			item.migrateState()
+		}
+	},
+}
+
+// encodeDB encodes items into a database file of the current
+// version.
+func encodeDB(items ItemsMap) ([]byte, error) {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(items)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, _DB_HEADER_SIZE, _DB_HEADER_SIZE+payload.Len())
+	n := copy(buf, _DB_MAGIC)
+	binary.BigEndian.PutUint32(buf[n:], _DB_VERSION)
+	binary.BigEndian.PutUint64(buf[n+4:], uint64(payload.Len()))
+	binary.BigEndian.PutUint32(buf[n+12:], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(buf, payload.Bytes()...), nil
+}
+
+// decodeDB decodes a database file, migrating its items to the
+// current version. An empty file holds no items.
+func decodeDB(data []byte) (items ItemsMap, err error) {
+	items = make(ItemsMap)
+	if len(data) == 0 {
+		return
+	}
+	version := 0
+	payload := data
+	if bytes.HasPrefix(data, []byte(_DB_MAGIC)) {
+		if len(data) < _DB_HEADER_SIZE {
+			return nil, fmt.Errorf("%w: truncated header", ErrDatabaseCorrupt)
+		}
+		n := len(_DB_MAGIC)
+		version = int(binary.BigEndian.Uint32(data[n:]))
+		length := binary.BigEndian.Uint64(data[n+4:])
+		sum := binary.BigEndian.Uint32(data[n+12:])
+		payload = data[_DB_HEADER_SIZE:]
+		if uint64(len(payload)) != length {
+			return nil, fmt.Errorf(
+				"%w: expected %d bytes of items, found %d",
+				ErrDatabaseCorrupt, length, len(payload),
+			)
+		}
+		if crc32.ChecksumIEEE(payload) != sum {
+			return nil, fmt.Errorf("%w: checksum mismatch", ErrDatabaseCorrupt)
+		}
+	}
+	if version > _DB_VERSION {
+		return nil, fmt.Errorf("%w: version %d", ErrDatabaseVersion, version)
+	}
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&items)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDatabaseCorrupt, err)
+	}
+	for ; version < _DB_VERSION; version++ {
+		dbMigrations[version](items)
+	}
+	return
+}
+
+// loadDB reads the database file at path, a missing file holds
+// no items.
+func loadDB(path string) (items ItemsMap, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(ItemsMap), nil
+	}
+	if err != nil {
+		return
+	}
+	items, err = decodeDB(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w (last good copy: %s)", path, err, getBackupPath(path))
+	}
+	return
+}
+
+// saveDB replaces the database file at path with items. The new
+// file is flushed to the disk before it's renamed over the old
+// one, which is kept as a backup, so that a crash leaves either
+// of them intact.
+func saveDB(path string, items ItemsMap) (err error) {
+	data, err := encodeDB(items)
+	if err != nil {
+		return
+	}
+	bak := getBackupPath(path)
+	os.Remove(bak)
+	// the backup is best effort, a failed link leaves the
+	// previous backup out of date.
+	_ = os.Link(path, bak)
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic replaces the file at path with data, which is
+// flushed to the disk before being renamed over the file.
+func writeFileAtomic(path string, data []byte) (err error) {
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if er := tmp.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return
+	}
+	syncDir(filepath.Dir(path))
+	return
+}
+
+func getBackupPath(path string) string {
+	return path + ".bak"
+}
+
+// syncDir flushes the entries of the directory to the disk,
+// it's a no-op on systems which can't sync directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	d.Close()
+}
@@ -0,0 +1,113 @@
+package warplib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testItems() ItemsMap {
+	return ItemsMap{
+		"a": {Hash: "a", TotalSize: 10, Downloaded: 10, State: ItemStateCompleted},
+		"b": {Hash: "b", TotalSize: 10, Downloaded: 4, State: ItemStatePaused},
+	}
+}
+
+func Test_decodeDB(t *testing.T) {
+	valid, err := encodeDB(testItems())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacy bytes.Buffer
+	err = gob.NewEncoder(&legacy).Encode(ItemsMap{
+		"a": {Hash: "a", TotalSize: 10, Downloaded: 10},
+		"b": {Hash: "b", TotalSize: 10, Downloaded: 4, Parts: map[int64]*ItemPart{0: {Hash: "p"}}},
+		// compiled parts of the old layout are at the save path.
+		"c": {Hash: "c", TotalSize: 10, Downloaded: 8, Parts: map[int64]*ItemPart{
+			0: {Hash: "p", FinalOffset: 4, Compiled: true},
+			5: {Hash: "q", FinalOffset: 9},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the item with compiled parts is restarted.
+	legacyStates := map[string]ItemState{"a": ItemStateCompleted, "b": ItemStatePaused, "c": ItemStatePending}
+	flipped := append([]byte(nil), valid...)
+	flipped[len(flipped)-1] ^= 0xff
+	newer := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(newer[len(_DB_MAGIC):], _DB_VERSION+1)
+	tests := []struct {
+		name       string
+		data       []byte
+		wantStates map[string]ItemState
+		wantErr    error
+	}{
+		{"empty", nil, map[string]ItemState{}, nil},
+		{"current", valid, map[string]ItemState{"a": ItemStateCompleted, "b": ItemStatePaused}, nil},
+		{"legacy", legacy.Bytes(), legacyStates, nil},
+		{"legacy trailing bytes", append(legacy.Bytes(), 1, 2, 3), legacyStates, nil},
+		{"truncated", valid[:len(valid)-3], nil, ErrDatabaseCorrupt},
+		{"truncated header", valid[:len(_DB_MAGIC)+2], nil, ErrDatabaseCorrupt},
+		{"flipped byte", flipped, nil, ErrDatabaseCorrupt},
+		{"garbage", []byte("not a database"), nil, ErrDatabaseCorrupt},
+		{"newer version", newer, nil, ErrDatabaseVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := decodeDB(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeDB() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(items) != len(tt.wantStates) {
+				t.Fatalf("decodeDB() returned %d items, want %d", len(items), len(tt.wantStates))
+			}
+			for hash, state := range tt.wantStates {
+				if items[hash] == nil || items[hash].State != state {
+					t.Errorf("decodeDB() item %q = %+v, want state %s", hash, items[hash], state)
+				}
+			}
+		})
+	}
+}
+
+func Test_saveDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "userdata.warp")
+	items, err := loadDB(path)
+	if err != nil || len(items) != 0 {
+		t.Fatalf("loadDB() of missing file = %v, %v", items, err)
+	}
+	if err = saveDB(path, testItems()); err != nil {
+		t.Fatal(err)
+	}
+	items = testItems()
+	delete(items, "a")
+	if err = saveDB(path, items); err != nil {
+		t.Fatal(err)
+	}
+	items, err = loadDB(path)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("loadDB() = %v, %v, want 1 item", items, err)
+	}
+	bak, err := loadDB(getBackupPath(path))
+	if err != nil || len(bak) != 2 {
+		t.Fatalf("loadDB() of backup = %v, %v, want 2 items", bak, err)
+	}
+	if err = os.WriteFile(path, []byte("WARPDB corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadDB(path); !errors.Is(err, ErrDatabaseCorrupt) {
+		t.Fatalf("loadDB() of corrupt file error = %v, want %v", err, ErrDatabaseCorrupt)
+	}
+	matches, _ := filepath.Glob(path + ".*.tmp")
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
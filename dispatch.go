@@ -0,0 +1,148 @@
+package warplib
+
+import "sync"
+
+// dispatcher emits the events of the parts of a download, or of
+// the downloads of a manager, from a single goroutine in the order
+// they were sent. Senders block while the queue is full so that
+// slow handlers hold back the parts instead of piling up events.
+type dispatcher struct {
+	emit func(Event)
+	// coalesce merges consecutive progress events of a part
+	// waiting in the queue into one.
+	coalesce bool
+	size     int
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []Event
+	closed   bool
+	done     chan struct{}
+}
+
+// newDispatcher starts a dispatcher passing the events to emit,
+// it has to be closed once no more events are sent.
+func newDispatcher(emit func(Event), size int, coalesce bool) *dispatcher {
+	if size <= 0 {
+		size = DEF_EVENT_QUEUE_SIZE
+	}
+	e := &dispatcher{
+		emit:     emit,
+		coalesce: coalesce,
+		size:     size,
+		done:     make(chan struct{}),
+	}
+	e.cond = sync.NewCond(&e.mu)
+	go e.run()
+	return e
+}
+
+// send queues the event, waiting for room while the queue is
+// full. Events sent once the dispatcher is closed are dropped.
+func (e *dispatcher) send(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	if e.coalesce && len(e.queue) != 0 {
+		last := &e.queue[len(e.queue)-1]
+		if merged, ok := coalesceEvents(*last, ev); ok {
+			*last = merged
+			return
+		}
+	}
+	for len(e.queue) >= e.size && !e.closed {
+		e.cond.Wait()
+	}
+	if e.closed {
+		return
+	}
+	e.queue = append(e.queue, ev)
+	e.cond.Broadcast()
+}
+
+// post queues the event without waiting for room, it's used by
+// senders which can't be held back.
+func (e *dispatcher) post(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	e.queue = append(e.queue, ev)
+	e.cond.Broadcast()
+}
+
+// coalesceEvents merges the progress event next into prev if
+// they're of the same kind and part.
+func coalesceEvents(prev, next Event) (Event, bool) {
+	switch p := prev.(type) {
+	case ProgressEvent:
+		if n, ok := next.(ProgressEvent); ok && n.Part == p.Part {
+			p.Bytes += n.Bytes
+			return p, true
+		}
+	case ResumeProgressEvent:
+		if n, ok := next.(ResumeProgressEvent); ok && n.Part == p.Part {
+			p.Bytes += n.Bytes
+			return p, true
+		}
+	case CompileProgressEvent:
+		if n, ok := next.(CompileProgressEvent); ok && n.Part == p.Part {
+			p.Bytes += n.Bytes
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// close waits for the queued events to be emitted and stops the
+// dispatcher.
+func (e *dispatcher) close() {
+	e.mu.Lock()
+	e.closed = true
+	e.cond.Broadcast()
+	e.mu.Unlock()
+	<-e.done
+}
+
+func (e *dispatcher) run() {
+	defer close(e.done)
+	for {
+		e.mu.Lock()
+		for len(e.queue) == 0 && !e.closed {
+			e.cond.Wait()
+		}
+		if len(e.queue) == 0 {
+			e.mu.Unlock()
+			return
+		}
+		ev := e.queue[0]
+		e.queue[0] = nil
+		e.queue = e.queue[1:]
+		e.cond.Broadcast()
+		e.mu.Unlock()
+		e.emit(ev)
+	}
+}
+
+// The methods below are passed to the parts, which report their
+// progress through the dispatcher of the download.
+
+func (d *Downloader) partProgress(hash string, nread int) {
+	d.fetched.Add(int64(nread))
+	d.ev.send(ProgressEvent{EventBase{d.hash}, hash, nread})
+}
+
+func (d *Downloader) partResumeProgress(hash string, nread int) {
+	d.resumed.Add(int64(nread))
+	d.ev.send(ResumeProgressEvent{EventBase{d.hash}, hash, nread})
+}
+
+func (d *Downloader) partCompileProgress(hash string, nread int) {
+	d.ev.send(CompileProgressEvent{EventBase{d.hash}, hash, nread})
+}
+
+func (d *Downloader) partComplete(hash string, tread int64) {
+	d.ev.send(CompletedEvent{EventBase{d.hash}, hash, tread})
+}
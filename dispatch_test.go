@@ -0,0 +1,78 @@
+package warplib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		coalesce bool
+		want     []string
+	}{
+		{"in order", false, []string{"spawn a", "a+1", "a+2", "b+3", "a+4", "merge a b", "done a 7"}},
+		{"coalesced", true, []string{"spawn a", "a+3", "b+3", "a+4", "merge a b", "done a 7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			release := make(chan struct{})
+			emit := func(ev Event) {
+				switch ev := ev.(type) {
+				case ResumeProgressEvent:
+					got = append(got, "spawn "+ev.Part)
+					// hold back delivery for events to queue up.
+					<-release
+				case ProgressEvent:
+					got = append(got, fmt.Sprintf("%s+%d", ev.Part, ev.Bytes))
+				case PartMergedEvent:
+					got = append(got, "merge "+ev.Part+" "+ev.Merged)
+				case CompletedEvent:
+					got = append(got, fmt.Sprintf("done %s %d", ev.Part, ev.Size))
+				}
+			}
+			e := newDispatcher(emit, 16, tt.coalesce)
+			e.send(ResumeProgressEvent{Part: "a"})
+			e.send(ProgressEvent{Part: "a", Bytes: 1})
+			e.send(ProgressEvent{Part: "a", Bytes: 2})
+			e.send(ProgressEvent{Part: "b", Bytes: 3})
+			e.send(ProgressEvent{Part: "a", Bytes: 4})
+			e.send(PartMergedEvent{Part: "a", Merged: "b", Foff: 10})
+			e.send(CompletedEvent{Part: "a", Size: 7})
+			close(release)
+			e.close()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("delivered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDispatcher_bounded(t *testing.T) {
+	release := make(chan struct{})
+	e := newDispatcher(func(Event) { <-release }, 2, false)
+	sent := make(chan struct{})
+	go func() {
+		// the first event is being delivered, the next
+		// two fill the queue.
+		for i := 0; i < 4; i++ {
+			e.send(ProgressEvent{Part: "a", Bytes: 1})
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("send didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// posted events don't wait for room.
+	e.post(StateChangedEvent{State: ItemStatePaused})
+	close(release)
+	<-sent
+	e.close()
+	// events sent once closed are dropped.
+	e.send(ProgressEvent{Part: "a", Bytes: 1})
+}
@@ -1,6 +1,7 @@
 package warplib
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -14,6 +15,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Downloader struct {
@@ -30,16 +33,23 @@ type Downloader struct {
 	// Size of 1 chunk of bytes to download during
 	// a single copy cycle
 	chunk int
-	// Max connections and number of curr connections
-	maxConn, numConn int
-	// Max spawnable parts and number of curr parts
-	maxParts, numParts int
+	// connections in use against the max connections
+	conns slots
+	// hosts shares the connection limits of the hosts,
+	// host holds the connections to the host of the url.
+	hosts *HostLimits
+	host  *hostConns
+	// parts spawned against the max spawnable parts
+	parts slots
 	// Initial number of parts to be spawned
 	numBaseParts int
 	// Setting force as 'true' will make downloader
 	// split the file into segments even if it doesn't
 	// have accept-ranges header.
 	force bool
+	// Setting direct as 'true' will make parts write
+	// straight into the main file at their offsets.
+	direct bool
 	// Handlers to be triggered while different events.
 	handlers *Handlers
 	// unique hash of this download
@@ -47,13 +57,72 @@ type Downloader struct {
 	// headers to use for http requests
 	headers Headers
 	// total downloaded bytes
-	nread  int64
+	nread  atomic.Int64
 	dlPath string
 	wg     *sync.WaitGroup
 	ohmap  VMap[int64, string]
+	// parts being downloaded, mapped by their offsets
+	active VMap[int64, *Part]
 	l      *log.Logger
 	lw     io.WriteCloser
 	f      *os.File
+	// ctx is cancelled once the download is stopped,
+	// all part requests are bound to it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// expected digests of the file
+	checksums []Checksum
+	// digester of the file, nil if there are no checksums
+	dg *digester
+	// don't verify the file against checksums sent by
+	// the server.
+	ignoreServerChecksums bool
+	// policy for retrying failed parts
+	retry RetryPolicy
+	// Setting noRange as 'true' will stop parts from
+	// being split, as the server doesn't honor ranges.
+	noRange bool
+	// err is the error the download was aborted with
+	err error
+	mu  sync.Mutex
+	// version of the remote file being downloaded
+	vd validator
+	// Setting restart as 'true' will make Resume download
+	// the file from scratch.
+	restart bool
+	// limiter caps the speed of this download
+	limiter *RateLimiter
+	// shared caps the combined speed of this download
+	// and others, it may be nil.
+	shared *RateLimiter
+	// directories used by the download
+	cfg *Config
+	// started is set once the download is started, done is
+	// closed once it returns.
+	started  bool
+	done     chan struct{}
+	doneOnce sync.Once
+	// mwg counts the download while it runs, it's the wait
+	// group of the manager the download belongs to.
+	mwg *sync.WaitGroup
+	// ev emits the events of the parts while the
+	// download runs.
+	ev *dispatcher
+	// listeners get the events before the handlers, they
+	// are set before the download is started.
+	listeners []func(Event)
+	// evch is the channel returned by Events, evdone is
+	// set once the download has returned.
+	evch   chan Event
+	evdone bool
+	// coalesce merges the progress events of a part
+	// waiting to be delivered.
+	coalesce bool
+	// fetched counts the bytes downloaded by this run and
+	// resumed the ones downloaded before it.
+	fetched, resumed atomic.Int64
+	// meter measures the speed of the download
+	meter speedMeter
 }
 
 // Optional fields of downloader
@@ -81,6 +150,45 @@ type DownloaderOpts struct {
 	Handlers *Handlers
 
 	SkipSetup bool
+	// Checksums are the expected digests of the file, the
+	// file is verified against them once it's downloaded.
+	Checksums []Checksum
+	// RetryPolicy configures retrying of failed parts,
+	// the default policy is used if it's nil.
+	RetryPolicy *RetryPolicy
+	// IgnoreServerChecksums stops the file from being verified
+	// against the digests sent by the server in the Digest,
+	// Repr-Digest, Content-MD5 or x-goog-hash headers.
+	IgnoreServerChecksums bool
+	// DirectWrite makes parts write straight into the
+	// preallocated download file at their offsets instead
+	// of separate part files, which removes the compile
+	// step and halves the disk I/O. Progress of each part
+	// is tracked in Item.Parts for resuming the download.
+	DirectWrite bool
+	// SpeedLimit caps the download speed in bytes per
+	// second, 0 means no limit. It can be changed later
+	// with SetSpeedLimit.
+	SpeedLimit int64
+	// SharedLimiter caps the combined speed of all the
+	// downloads using it, in addition to SpeedLimit.
+	// Manager.AddDownload sets it to the limiter of the
+	// manager if it's nil.
+	SharedLimiter *RateLimiter
+	// Config sets the directories used by the download, the
+	// default directories are used if it's nil. It has to
+	// match the config of the manager the download is added
+	// to, see Manager.AddDownload.
+	Config *Config
+	// HostLimits shares the connection limit of a host which
+	// pushed back with the other downloads from it. Manager.
+	// AddDownload sets it to the host limits of the manager if
+	// it's nil, the download keeps its own limits otherwise.
+	HostLimits *HostLimits
+	// CoalesceProgress merges the progress events of a part
+	// which are waiting to be delivered into one, so that
+	// slow handlers get fewer calls with more bytes each.
+	CoalesceProgress bool
 }
 
 // NewDownloader creates a new downloader with provided arguments.
@@ -110,27 +218,48 @@ func NewDownloader(client *http.Client, url string, opts *DownloaderOpts) (d *Do
 	if err != nil {
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	d = &Downloader{
-		wg:       &sync.WaitGroup{},
-		client:   client,
-		url:      url,
-		maxConn:  opts.MaxConnections,
-		chunk:    int(DEF_CHUNK_SIZE),
-		force:    opts.ForceParts,
-		handlers: opts.Handlers,
-		fileName: opts.FileName,
-		dlLoc:    opts.DownloadDirectory,
-		maxParts: opts.MaxSegments,
-		headers:  opts.Headers,
+		ctx:                   ctx,
+		cancel:                cancel,
+		done:                  make(chan struct{}),
+		wg:                    &sync.WaitGroup{},
+		client:                client,
+		url:                   url,
+		chunk:                 int(DEF_CHUNK_SIZE),
+		force:                 opts.ForceParts,
+		direct:                opts.DirectWrite,
+		handlers:              opts.Handlers,
+		fileName:              opts.FileName,
+		dlLoc:                 opts.DownloadDirectory,
+		headers:               opts.Headers,
+		ignoreServerChecksums: opts.IgnoreServerChecksums,
+		limiter:               NewRateLimiter(opts.SpeedLimit),
+		shared:                opts.SharedLimiter,
+		hosts:                 opts.HostLimits,
+		coalesce:              opts.CoalesceProgress,
+		// server checksums are appended to a copy.
+		checksums: append([]Checksum(nil), opts.Checksums...),
 	}
+	d.conns.setLimit(opts.MaxConnections)
+	d.parts.setLimit(opts.MaxSegments)
+	d.setRetryPolicy(opts.RetryPolicy)
 	err = d.fetchInfo()
 	if err != nil {
 		return
 	}
+	d.dg, err = newDigester(d.checksums)
+	if err != nil {
+		return
+	}
 	if opts.SkipSetup {
 		// Skip setting up dl path and stuff for a general download lookup.
 		return
 	}
+	d.cfg, err = resolveConfig(opts.Config)
+	if err != nil {
+		return
+	}
 	d.setHash()
 	err = d.setupDlPath()
 	if err != nil {
@@ -144,16 +273,28 @@ func NewDownloader(client *http.Client, url string, opts *DownloaderOpts) (d *Do
 	if opts.NumBaseParts != 0 {
 		d.numBaseParts = opts.NumBaseParts
 	}
-	if d.maxParts != 0 && d.maxConn > d.maxParts {
-		d.maxConn = d.maxParts
+	if max := d.parts.limit(); max != 0 && d.conns.limit() > max {
+		d.conns.setLimit(max)
+	}
+	d.capBaseParts()
+	return
+}
+
+// capBaseParts limits the initial number of parts to the
+// maximum connections and segments.
+func (d *Downloader) capBaseParts() {
+	if d.numBaseParts > d.conns.limit() {
+		d.numBaseParts = d.conns.limit()
+	}
+	if max := d.parts.limit(); max != 0 && d.numBaseParts > max {
+		d.numBaseParts = max
 	}
-	if d.numBaseParts > d.maxConn {
-		d.numBaseParts = d.maxConn
+	if d.host == nil {
+		return
 	}
-	if d.maxParts != 0 && d.numBaseParts > d.maxParts {
-		d.numBaseParts = d.maxParts
+	if max := d.host.limit(); max != 0 && d.numBaseParts > max {
+		d.numBaseParts = max
 	}
-	return
 }
 
 func initDownloader(client *http.Client, hash, url string, cLength ContentLength, opts *DownloaderOpts) (d *Downloader, err error) {
@@ -182,20 +323,40 @@ func initDownloader(client *http.Client, hash, url string, cLength ContentLength
 	if err != nil {
 		return
 	}
+	cfg, err := resolveConfig(opts.Config)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	d = &Downloader{
+		cfg:           cfg,
+		ctx:           ctx,
+		cancel:        cancel,
+		done:          make(chan struct{}),
 		wg:            &sync.WaitGroup{},
 		client:        client,
 		url:           url,
-		maxConn:       opts.MaxConnections,
 		chunk:         int(DEF_CHUNK_SIZE),
 		force:         opts.ForceParts,
+		direct:        opts.DirectWrite,
 		handlers:      opts.Handlers,
 		fileName:      opts.FileName,
 		dlLoc:         opts.DownloadDirectory,
-		maxParts:      opts.MaxSegments,
 		contentLength: cLength,
 		hash:          hash,
-		dlPath:        fmt.Sprintf("%s/%s/", DlDataDir, hash),
+		dlPath:        cfg.dataPath(hash),
+		limiter:       NewRateLimiter(opts.SpeedLimit),
+		shared:        opts.SharedLimiter,
+		hosts:         opts.HostLimits,
+		coalesce:      opts.CoalesceProgress,
+	}
+	d.conns.setLimit(opts.MaxConnections)
+	d.parts.setLimit(opts.MaxSegments)
+	d.setRetryPolicy(opts.RetryPolicy)
+	d.checksums = opts.Checksums
+	d.dg, err = newDigester(d.checksums)
+	if err != nil {
+		return
 	}
 	if !dirExists(d.dlPath) {
 		err = errors.New("path to downloaded content doesn't exist")
@@ -206,8 +367,8 @@ func initDownloader(client *http.Client, hash, url string, cLength ContentLength
 		return
 	}
 	d.handlers.setDefault(d.l)
-	if d.maxParts != 0 && d.maxConn > d.maxParts {
-		d.maxConn = d.maxParts
+	if max := d.parts.limit(); max != 0 && d.conns.limit() > max {
+		d.conns.setLimit(max)
 	}
 	return
 }
@@ -215,98 +376,400 @@ func initDownloader(client *http.Client, hash, url string, cLength ContentLength
 // Start downloads the file and blocks current goroutine
 // until the downloading is complete.
 func (d *Downloader) Start() (err error) {
+	return d.StartContext(context.Background())
+}
+
+// StartContext is like Start but the download is stopped
+// as soon as ctx is done, see Stop for details.
+func (d *Downloader) StartContext(ctx context.Context) (err error) {
 	defer d.lw.Close()
+	end, err := d.run()
+	if err != nil {
+		return
+	}
+	defer end()
+	// the host may have pushed back on other downloads.
+	d.capBaseParts()
+	d.emitState(ItemStateRunning, nil)
 	err = d.openFile()
 	if err != nil {
+		d.emitState(ItemStateFailed, err)
 		return
 	}
-	defer func() {
-		d.f.Close()
-		// err = os.Rename(d.fName, d.GetSavePath())
-	}()
+	defer d.f.Close()
+	release := d.watch(ctx)
+	defer release()
 	d.Log("Starting download...")
 	d.ohmap.Make()
+	d.active.Make()
+	d.ev = newDispatcher(d.emit, DEF_EVENT_QUEUE_SIZE, d.coalesce)
+	if d.contentLength.IsUnknown() {
+		d.acquireConn()
+		d.wg.Add(1)
+		go d.streamPartDownload("")
+	}
 	partSize, rpartSize := d.getPartSize()
-	for i := 0; i < d.numBaseParts; i++ {
+	for i := 0; i < d.numBaseParts && partSize != -1; i++ {
 		ioff := int64(i) * partSize
 		foff := ioff + partSize - 1
 		if i == d.numBaseParts-1 {
 			foff += rpartSize
 		}
+		// base parts are within the limits.
+		d.acquireConn()
+		d.parts.acquire()
 		d.wg.Add(1)
 		go d.newPartDownload(ioff, foff, 4*MB)
 	}
 	d.wg.Wait()
-	if d.contentLength.v() != d.nread {
-		d.Log("Download failed", "Expected bytes:", d.contentLength, "Found bytes:", d.nread)
-		return
-	}
-	d.handlers.DownloadCompleteHandler(MAIN_HASH, d.contentLength.v())
-	d.Log("All segments downloaded!")
-	return
+	// events are delivered before the download is
+	// concluded.
+	d.ev.close()
+	return d.finish()
 }
 
-// TODO: fix concurrent write and iteration if any.
-
 // map[InitialOffset(int64)]ItemPart
 func (d *Downloader) Resume(parts map[int64]*ItemPart) (err error) {
+	return d.ResumeContext(context.Background(), parts)
+}
+
+// ResumeContext is like Resume but the download is stopped
+// as soon as ctx is done, see Stop for details.
+func (d *Downloader) ResumeContext(ctx context.Context, parts map[int64]*ItemPart) (err error) {
+	if d.restart {
+		return d.StartContext(ctx)
+	}
 	defer d.lw.Close()
 	if len(parts) == 0 {
 		return errors.New("download is already complete")
 	}
+	end, err := d.run()
+	if err != nil {
+		return
+	}
+	defer end()
+	d.emitState(ItemStateRunning, nil)
 	err = d.openFile()
 	if err != nil {
+		d.emitState(ItemStateFailed, err)
 		return
 	}
-	defer func() {
-		d.f.Close()
-		// err = os.Rename(d.fName, d.GetSavePath())
-	}()
+	defer d.f.Close()
+	release := d.watch(ctx)
+	defer release()
 	d.Log("Resuming download...")
 	d.ohmap.Make()
+	d.active.Make()
+	d.ev = newDispatcher(d.emit, DEF_EVENT_QUEUE_SIZE, d.coalesce)
 	espeed := 4 * MB / int64(len(parts))
 	for ioff, ip := range parts {
+		if d.contentLength.IsUnknown() {
+			d.acquireConn()
+			d.wg.Add(1)
+			go d.streamPartDownload(ip.Hash)
+			break
+		}
 		if ip.Compiled {
-			d.handlers.CompileSkippedHandler(ip.Hash, ip.FinalOffset-ioff)
+			d.digest(ioff, ip.FinalOffset)
+			d.nread.Add(ip.FinalOffset - ioff + 1)
+			d.resumed.Add(ip.FinalOffset - ioff + 1)
+			d.ev.send(CompileSkippedEvent{EventBase{d.hash}, ip.Hash, ip.FinalOffset - ioff})
 			continue
 		}
+		d.acquireConn()
 		d.wg.Add(1)
-		go d.resumePartDownload(ip.Hash, ioff, ip.FinalOffset, espeed)
+		go d.resumePartDownload(ip.Hash, ioff, ip.FinalOffset, ip.Downloaded, espeed)
 	}
 	d.wg.Wait()
-	if d.contentLength.v() != d.nread {
-		d.Log("Download failed", "Expected bytes:", d.contentLength, "Found bytes:", d.nread)
+	// events are delivered before the download is
+	// concluded.
+	d.ev.close()
+	return d.finish()
+}
+
+// finish concludes the download once every part has returned,
+// the downloaded file is finalized if no bytes are missing.
+func (d *Downloader) finish() (err error) {
+	if d.IsStopped() {
+		d.Log("Download stopped", "Downloaded bytes:", d.nread.Load())
+		err = d.getErr()
+		d.emit(StoppedEvent{EventBase{d.hash}, err})
+		if err != nil {
+			d.emitState(ItemStateFailed, err)
+		} else {
+			d.emitState(ItemStatePaused, nil)
+		}
+		return
+	}
+	if d.contentLength.v() != d.nread.Load() {
+		// parts gave up or failed.
+		err = &IncompleteError{d.contentLength.v(), d.nread.Load()}
+		d.Log("Download failed: %s", err.Error())
+		d.emit(ErrorEvent{EventBase{d.hash}, MAIN_HASH, err})
+		d.emitState(ItemStateFailed, err)
 		return
 	}
-	d.handlers.DownloadCompleteHandler(MAIN_HASH, d.contentLength.v())
 	d.Log("All segments downloaded!")
+	err = d.verify()
+	if err == nil {
+		err = d.finalize()
+	}
+	if err != nil {
+		d.emit(ErrorEvent{EventBase{d.hash}, MAIN_HASH, err})
+		d.emitState(ItemStateFailed, err)
+		return
+	}
+	d.emit(CompletedEvent{EventBase{d.hash}, MAIN_HASH, d.contentLength.v()})
+	d.emitState(ItemStateCompleted, nil)
 	return
 }
 
+// IncompleteError is returned when the parts of a download have
+// returned without downloading all of its bytes, because they
+// failed or gave up retrying.
+type IncompleteError struct {
+	// Expected is the size of the file, -1 if it's unknown.
+	Expected   int64
+	Downloaded int64
+}
+
+func (e *IncompleteError) Error() string {
+	if e.Expected < 0 {
+		return fmt.Sprintf("%s: downloaded %d bytes of unknown size", ErrDownloadIncomplete, e.Downloaded)
+	}
+	return fmt.Sprintf("%s: downloaded %d of %d bytes", ErrDownloadIncomplete, e.Downloaded, e.Expected)
+}
+
+func (e *IncompleteError) Is(target error) bool {
+	return target == ErrDownloadIncomplete
+}
+
+// verify verifies the downloaded file against the expected
+// checksums, the file isn't finalized if they don't match.
+func (d *Downloader) verify() (err error) {
+	if d.dg == nil {
+		return
+	}
+	d.Log("Verifying checksums...")
+	d.emitState(ItemStateVerifying, nil)
+	err = d.dg.verify(d.contentLength.v(), func(sum Checksum, err error) {
+		if err == nil {
+			d.Log("%s checksum verified", sum.Algorithm)
+		}
+		d.emit(VerifiedEvent{EventBase{d.hash}, sum, err})
+	})
+	return
+}
+
+// digest marks the bytes from ioff till foff as written to
+// the file for them to be digested.
+func (d *Downloader) digest(ioff, foff int64) {
+	if d.dg == nil {
+		return
+	}
+	d.dg.written(ioff, foff)
+}
+
+// partWritten passes the bytes a part downloaded for off to the
+// digester.
+func (d *Downloader) partWritten(off int64, b []byte) {
+	if d.dg == nil {
+		return
+	}
+	d.dg.feed(off, b)
+}
+
+// finalize moves the downloaded file from the download data
+// directory to its save path, falling back to copying it if
+// they are on different filesystems, and removes the download
+// data afterwards.
+func (d *Downloader) finalize() (err error) {
+	err = d.f.Close()
+	if err != nil {
+		return
+	}
+	svPath := d.GetSavePath()
+	d.Log("Moving downloaded file to %s", svPath)
+	err = moveFile(d.getStagingPath(), svPath, func(n int) {
+		d.emit(FinalizeProgressEvent{EventBase{d.hash}, n})
+	})
+	if err != nil {
+		return
+	}
+	d.Log("Download finalized, removing download data")
+	// logs are part of download data.
+	d.lw.Close()
+	er := os.RemoveAll(d.dlPath)
+	if er != nil {
+		d.emit(ErrorEvent{EventBase{d.hash}, MAIN_HASH, er})
+	}
+	return
+}
+
+// Stop stops the download by cancelling every in-flight
+// part request. Bytes downloaded so far are flushed to the
+// part files, so that the download can later be resumed
+// with Manager.ResumeDownload.
+// Start (or Resume) returns once every part has stopped.
+func (d *Downloader) Stop() {
+	d.cancel()
+}
+
+// run marks the download as started, the returned function
+// must be called once it returns. A download stopped before
+// being started isn't run and fails with ErrDownloadStopped.
+func (d *Downloader) run() (end func(), err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.IsStopped() {
+		return nil, ErrDownloadStopped
+	}
+	d.started = true
+	if d.hosts == nil {
+		d.hosts = NewHostLimits()
+	}
+	d.host = d.hosts.get(getHost(d.url))
+	d.meter.start(time.Now(), d.fetched.Load())
+	if d.mwg != nil {
+		d.mwg.Add(1)
+	}
+	end = func() {
+		d.closeEvents()
+		if d.mwg != nil {
+			d.mwg.Done()
+		}
+		d.doneOnce.Do(func() { close(d.done) })
+	}
+	return
+}
+
+// stopAndWait stops the download and waits for it to return,
+// it returns right away if the download wasn't started.
+func (d *Downloader) stopAndWait() {
+	d.Stop()
+	d.mu.Lock()
+	started := d.started
+	d.mu.Unlock()
+	if started {
+		<-d.done
+	}
+}
+
+// retire stops a download which was never started once it's
+// replaced by another download of its item, closing its log as
+// Start and Resume would.
+func (d *Downloader) retire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		return
+	}
+	d.cancel()
+	d.lw.Close()
+}
+
+// abort stops the download due to err, which is returned by
+// Start or Resume.
+func (d *Downloader) abort(err error) {
+	d.mu.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.mu.Unlock()
+	d.Log("Aborting download: %s", err.Error())
+	d.Stop()
+}
+
+func (d *Downloader) getErr() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// isDone reports whether the download has returned.
+func (d *Downloader) isDone() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// isRunning reports whether the download has been started and
+// hasn't returned yet.
+func (d *Downloader) isRunning() bool {
+	d.mu.Lock()
+	started := d.started
+	d.mu.Unlock()
+	return started && !d.isDone()
+}
+
+// IsStopped reports whether the download has been stopped.
+func (d *Downloader) IsStopped() bool {
+	return d.ctx.Err() != nil
+}
+
+// watch stops the download once ctx is done, the returned
+// function must be called to release the watcher.
+func (d *Downloader) watch(ctx context.Context) (release func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.Stop()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// openFile opens the file parts are compiled into, it lives
+// in the download data directory till the download is
+// finalized.
 func (d *Downloader) openFile() (err error) {
-	// d.fName = d.dlPath + "warp.dl"
-	d.f, err = os.OpenFile(d.GetSavePath(),
+	d.f, err = os.OpenFile(d.getStagingPath(),
 		os.O_RDWR|os.O_CREATE,
 		0666,
 	)
+	if err != nil {
+		return
+	}
+	if d.dg != nil {
+		d.dg.setFile(d.f)
+	}
+	if !d.direct || d.contentLength.IsUnknown() {
+		return
+	}
+	// preallocate the file for parts to write at
+	// their offsets.
+	err = d.f.Truncate(d.contentLength.v())
+	if err != nil {
+		d.f.Close()
+	}
 	return
 }
 
 func (d *Downloader) spawnPart(ioff, foff int64) (part *Part, err error) {
 	part, err = newPart(
-		d.wg,
 		d.client,
 		d.url,
 		partArgs{
 			d.chunk,
 			d.dlPath,
-			d.handlers.ResumeProgressHandler,
-			d.handlers.DownloadProgressHandler,
-			d.handlers.DownloadCompleteHandler,
-			d.handlers.CompileProgressHandler,
+			d.partResumeProgress,
+			d.partProgress,
+			d.partComplete,
+			d.partCompileProgress,
 			d.l,
 			ioff,
 			d.f,
+			d.direct,
+			0,
+			d.vd,
+			d.limiters(),
+			d.noRange,
+			d.partWritten,
 		},
 	)
 	if err != nil {
@@ -314,109 +777,148 @@ func (d *Downloader) spawnPart(ioff, foff int64) (part *Part, err error) {
 	}
 	// part.offset = ioff
 	d.ohmap.Set(ioff, part.hash)
-	d.numParts++
 	d.Log("%s: Created new part", part.hash)
-	d.handlers.SpawnPartHandler(part.hash, ioff, foff)
+	d.ev.send(PartSpawnedEvent{EventBase{d.hash}, part.hash, ioff, foff})
 	return
 }
 
-func (d *Downloader) initPart(hash string, ioff, foff int64) (part *Part, err error) {
+func (d *Downloader) initPart(hash string, ioff, foff, read int64) (part *Part, err error) {
 	part, err = initPart(
-		d.wg,
 		d.client,
 		hash,
 		d.url,
 		partArgs{
 			d.chunk,
 			d.dlPath,
-			d.handlers.ResumeProgressHandler,
-			d.handlers.DownloadProgressHandler,
-			d.handlers.DownloadCompleteHandler,
-			d.handlers.CompileProgressHandler,
+			d.partResumeProgress,
+			d.partProgress,
+			d.partComplete,
+			d.partCompileProgress,
 			d.l,
 			ioff,
 			d.f,
+			d.direct,
+			read,
+			d.vd,
+			d.limiters(),
+			d.noRange,
+			d.partWritten,
 		},
 	)
 	if err != nil {
 		return
 	}
 	d.ohmap.Set(ioff, hash)
-	d.numParts++
+	d.parts.acquire()
 	d.Log("%s: Resumed part", hash)
-	d.handlers.SpawnPartHandler(hash, ioff, foff)
+	d.ev.send(PartSpawnedEvent{EventBase{d.hash}, hash, ioff, foff})
 	return
 }
 
-func (d *Downloader) resumePartDownload(hash string, ioff, foff, espeed int64) {
-	d.numConn++
-	part, err := d.initPart(hash, ioff, foff)
+// resumePartDownload resumes the part with hash, the connection
+// slot of it must be taken by the caller.
+func (d *Downloader) resumePartDownload(hash string, ioff, foff, read, espeed int64) {
+	defer func() { d.releaseConn(); d.wg.Done() }()
+	part, err := d.initPart(hash, ioff, foff, read)
 	if err != nil {
-		d.Log("%s: init: %w", hash, err)
+		d.Log("%s: init: %s", hash, err.Error())
 		return
 	}
-	defer func() { d.numConn--; d.wg.Done() }()
 	poff := part.offset + part.read
 	if poff >= foff {
 		d.Log("%s: part offset (%d) greater than final offset (%d)", hash, poff, foff)
 		return
 	}
-	err = d.runPart(part, poff, foff, espeed, false)
-	d.nread += part.read
+	d.downloadPart(part, poff, foff, espeed)
+}
+
+// newPartDownload downloads a new part from ioff till foff, the
+// connection and part slots of it must be taken by the caller.
+func (d *Downloader) newPartDownload(ioff, foff, espeed int64) {
+	defer func() { d.releaseConn(); d.wg.Done() }()
+	part, err := d.spawnPart(ioff, foff)
 	if err != nil {
+		d.parts.release()
+		d.Log("failed to spawn new part: %s", err.Error())
 		return
 	}
-	d.handlers.CompileStartHandler(part.hash)
-	defer d.handlers.CompileCompleteHandler(part.hash, part.read)
-
-	d.Log("%s: compiling part", hash)
+	d.downloadPart(part, ioff, foff, espeed)
+}
 
-	var read, written int64
-	read, written, err = part.compile()
+// downloadPart downloads the part from ioff till foff, merging
+// the parts next to it whenever it catches up with them, and
+// compiles it afterwards.
+func (d *Downloader) downloadPart(part *Part, ioff, foff, espeed int64) {
+	part.ctx, part.cancel = context.WithCancel(d.ctx)
+	defer part.cancel()
+	d.active.Set(part.offset, part)
 
-	// close part file
-	part.close()
+	err := d.runPart(part, ioff, foff, espeed, false)
+	for err == nil && d.mergeNext(part) {
+		err = d.runPart(part, part.offset+part.read, part.foff, espeed, false)
+	}
 
-	if err != nil {
-		d.Log("%s: compile: %w", hash, err)
+	d.active.Delete(part.offset)
+	if part.release() {
+		// the part which absorbed this part takes
+		// care of its bytes and part file.
+		d.Log("%s: part absorbed", part.hash)
 		return
 	}
-	d.Log("%s: compilation complete: read %d bytes and wrote %d bytes", hash, read, written)
-
-	fName := getFileName(
-		d.dlPath,
-		hash,
-	)
-	err = os.Remove(fName)
-	if err == nil {
+	d.nread.Add(part.read)
+	if err != nil {
+		part.close()
 		return
 	}
-	d.Log("%s: remove: %w", hash, err)
+	d.finishPart(part)
 }
 
-func (d *Downloader) newPartDownload(ioff, foff, espeed int64) {
-	d.numConn++
-	part, err := d.spawnPart(ioff, foff)
+// mergeNext makes the part absorb the remaining range of the
+// part next to it once it has caught up to the start offset
+// of its neighbour, which frees the connection slot of the
+// neighbour. Only neighbours with a large pending range are
+// absorbed, it reports whether the parts were merged.
+func (d *Downloader) mergeNext(part *Part) bool {
+	if part.ctx.Err() != nil || part.offset+part.read != part.foff+1 {
+		return false
+	}
+	next := d.active.Get(part.foff + 1)
+	if next == nil || next.remaining() < _MIN_MERGE_SIZE {
+		return false
+	}
+	if !next.absorb() {
+		return false
+	}
+	err := part.merge(next)
 	if err != nil {
-		d.Log("failed to spawn new part: %w", err)
-		return
+		d.ev.post(ErrorEvent{EventBase{d.hash}, part.hash, err})
+		return false
 	}
-	hash := part.hash
+	d.parts.release()
+	d.Log("%s: merged part %s, new final offset %d", part.hash, next.hash, part.foff)
+	d.ev.send(PartMergedEvent{EventBase{d.hash}, part.hash, next.hash, part.offset, part.foff})
+	return true
+}
 
-	defer func() { d.numConn--; d.wg.Done() }()
-	err = d.runPart(part, ioff, foff, espeed, false)
-	d.nread += part.read
-	if err != nil {
+// finishPart compiles a downloaded part into the main file
+// and removes its part file.
+func (d *Downloader) finishPart(part *Part) {
+	hash := part.hash
+	if d.direct {
+		// part has been written to the main file
+		// already, there is nothing to compile.
+		d.Log("%s: part written directly to main file", hash)
+		d.digest(part.offset, part.offset+part.read-1)
+		d.ev.send(CompileCompletedEvent{EventBase{d.hash}, hash, part.read})
 		return
 	}
 
-	d.handlers.CompileStartHandler(part.hash)
-	defer d.handlers.CompileCompleteHandler(part.hash, part.read)
+	d.ev.send(CompileStartedEvent{EventBase{d.hash}, hash})
+	defer func() { d.ev.send(CompileCompletedEvent{EventBase{d.hash}, hash, part.read}) }()
 
 	d.Log("%s: compiling part", hash)
 
-	var read, written int64
-	read, written, err = part.compile()
+	read, written, err := part.compile()
 
 	// close part file
 	part.close()
@@ -426,6 +928,7 @@ func (d *Downloader) newPartDownload(ioff, foff, espeed int64) {
 		return
 	}
 	d.Log("%s: compilation complete: read %d bytes and wrote %d bytes", hash, read, written)
+	d.digest(part.offset, part.offset+written-1)
 
 	fName := getFileName(
 		d.dlPath,
@@ -438,12 +941,83 @@ func (d *Downloader) newPartDownload(ioff, foff, espeed int64) {
 	d.Log("%s: remove: %w", hash, err)
 }
 
+// streamPartDownload downloads the content of unknown size
+// over a single connection, writing it straight to the main
+// file. A non-empty hash resumes the stream part with that
+// hash from the current size of the main file.
+func (d *Downloader) streamPartDownload(hash string) {
+	defer func() { d.releaseConn(); d.wg.Done() }()
+	part, err := d.spawnStreamPart(hash)
+	if err != nil {
+		d.Log("failed to spawn stream part: %s", err.Error())
+		return
+	}
+	part.ctx, part.cancel = context.WithCancel(d.ctx)
+	defer part.cancel()
+	err = d.runPart(part, part.read, -1, 4*MB, false)
+	d.nread.Add(part.read)
+	if err != nil {
+		return
+	}
+	// size of the content is known once the stream ends.
+	d.mu.Lock()
+	d.contentLength = ContentLength(part.read)
+	d.mu.Unlock()
+	err = d.f.Truncate(part.read)
+	if err != nil {
+		d.ev.post(ErrorEvent{EventBase{d.hash}, part.hash, err})
+		return
+	}
+	d.Log("%s: stream complete: downloaded %d bytes", part.hash, part.read)
+}
+
+func (d *Downloader) spawnStreamPart(hash string) (part *Part, err error) {
+	var off int64
+	if hash != "" {
+		fi, er := d.f.Stat()
+		if er != nil {
+			err = er
+			return
+		}
+		off = fi.Size()
+	}
+	part = newStreamPart(
+		d.client,
+		hash,
+		d.url,
+		partArgs{
+			copyChunk: d.chunk,
+			pHandler:  d.partProgress,
+			oHandler:  d.partComplete,
+			cpHandler: d.partCompileProgress,
+			wHandler:  d.partWritten,
+			logger:    d.l,
+			offset:    off,
+			f:         d.f,
+			vd:        d.vd,
+			limiters:  d.limiters(),
+		},
+	)
+	d.ohmap.Set(0, part.hash)
+	d.parts.acquire()
+	if hash == "" {
+		d.Log("%s: Created new stream part", part.hash)
+	} else {
+		d.Log("%s: Resumed stream part from offset %d", hash, off)
+		d.resumed.Add(off)
+		d.ev.send(ResumeProgressEvent{EventBase{d.hash}, hash, int(off)})
+	}
+	d.ev.send(PartSpawnedEvent{EventBase{d.hash}, part.hash, 0, -1})
+	return
+}
+
 // runPart downloads the content starting from ioff till foff bytes
 // offset. espeed stands for expected download speed which, slower
 // download speed than this espeed will result in spawning a new part
 // if a slot is available for it and maximum parts limit is not reached.
 func (d *Downloader) runPart(part *Part, ioff, foff, espeed int64, repeated bool) error {
 	hash := part.hash
+	part.setFoff(foff)
 	// set espeed each time the runPart function is called to update
 	// the older espeed present in respawned parts.
 	part.setEpeed(espeed)
@@ -455,32 +1029,43 @@ func (d *Downloader) runPart(part *Part, ioff, foff, espeed int64, repeated bool
 	// start downloading the content in provided
 	// offset range until part becomes slower than
 	// expected speed.
-	slow, err := part.download(d.headers, ioff, foff, false)
+	slow, err := part.download(part.ctx, d.headers, ioff, foff, false)
 	if err != nil {
-		d.handlers.ErrorHandler(hash, err)
+		if d.retryPart(part, err) {
+			return d.runPart(part, part.offset+part.read, foff, espeed, true)
+		}
+		d.reportError(part, err)
 		return err
 	}
 	if !slow {
 		return nil
 	}
+	if part.ctx.Err() != nil {
+		// don't split stopped parts.
+		return part.ctx.Err()
+	}
 	d.Log("%s: Detected part as running slow", hash)
 
 	// add read bytes to part offset to determine
 	// starting offset for a resplit download.
 	poff := part.offset + part.read
 
-	if d.maxParts != 0 && d.numParts >= d.maxParts {
+	if d.noRange || !d.parts.tryAcquire() {
 		// Max part limit has been reached and hence
 		// don't spawn new parts and forcefully download
 		// rest of the content in slow part.
 		d.Log("%s: Max part limit reached, continuing slow part...", hash)
-		_, err = part.download(d.headers, poff, foff, true)
+		_, err = part.download(part.ctx, d.headers, poff, foff, true)
 		if err != nil {
-			d.handlers.ErrorHandler(hash, err)
-			return err
+			if d.retryPart(part, err) {
+				return d.runPart(part, part.offset+part.read, foff, espeed, true)
+			}
+			d.reportError(part, err)
 		}
+		return err
 	}
-	if d.maxConn != 0 && d.numConn >= d.maxConn {
+	if !d.tryAcquireConn() {
+		d.parts.release()
 		// It waits until a connection is
 		// freed and spawns a new part once
 		// a slot is available.
@@ -494,21 +1079,152 @@ func (d *Downloader) runPart(part *Part, ioff, foff, espeed int64, repeated bool
 	// spawned part.
 	div := (foff - poff) / 2
 
-	// spawn a new part and add its goroutine to
-	// waitgroup, new part will download the last
-	// 2nd half of pending bytes.
+	// spawn a new part in the slots taken above and
+	// add its goroutine to waitgroup, new part will
+	// download the last 2nd half of pending bytes.
 	d.wg.Add(1)
 	go d.newPartDownload(poff+div, foff, espeed/2)
 
 	// current part will download the first half
 	// of pending bytes.
 	foff = poff + div - 1
+	part.setFoff(foff)
 
 	d.Log("%s: part respawned", hash)
-	d.handlers.RespawnPartHandler(hash, part.offset, poff, foff)
+	d.ev.send(PartRespawnedEvent{EventBase{d.hash}, hash, part.offset, poff, foff})
 	return d.runPart(part, poff, foff, espeed/2, false)
 }
 
+// retryPart waits for the backoff delay before a failed part
+// is retried. It reports false if err isn't retryable or the
+// part has run out of attempts. A part the server pushed back
+// on gives up its connection to the host while it waits, and
+// waits for a free one afterwards.
+func (d *Downloader) retryPart(part *Part, err error) bool {
+	if part.ctx.Err() != nil || !isRetryable(err) {
+		return false
+	}
+	if part.read != part.fread {
+		// part made progress since it last failed.
+		part.attempts = 0
+		part.fread = part.read
+	}
+	part.attempts++
+	if part.attempts >= d.retry.MaxAttempts {
+		d.Log("%s: giving up after %d attempts", part.hash, part.attempts)
+		return false
+	}
+	delay, pushback := d.retry.delay(part.attempts, err)
+	if pushback {
+		d.lowerMaxConn(part.hash)
+	}
+	d.Log("%s: retrying in %s (attempt %d): %s", part.hash, delay, part.attempts, err.Error())
+	// the part mustn't be held back from giving up its slot.
+	d.ev.post(RetryEvent{EventBase{d.hash}, part.hash, part.attempts, delay, err})
+	if pushback {
+		d.host.release()
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-part.ctx.Done():
+	}
+	if !pushback {
+		return part.ctx.Err() == nil
+	}
+	if d.host.acquire(part.ctx) != nil {
+		// the slot is released once the part returns.
+		d.host.take()
+		return false
+	}
+	return true
+}
+
+// lowerMaxConn lowers the maximum number of connections to the
+// host of the download below the number of connections running
+// currently, once the server pushes back on them. The limit is
+// shared with the other downloads from the host.
+func (d *Downloader) lowerMaxConn(hash string) {
+	n := d.host.lower()
+	if n == 0 {
+		return
+	}
+	d.Log("%s: server pushed back, lowered max connections to %s to %d", hash, getHost(d.url), n)
+}
+
+// acquireConn takes a connection slot of the download and its
+// host regardless of their limits.
+func (d *Downloader) acquireConn() {
+	d.conns.acquire()
+	d.host.take()
+}
+
+// tryAcquireConn takes a connection slot of the download and
+// its host if both have one free, it reports whether the slots
+// were taken.
+func (d *Downloader) tryAcquireConn() bool {
+	if !d.conns.tryAcquire() {
+		return false
+	}
+	if !d.host.tryAcquire() {
+		d.conns.release()
+		return false
+	}
+	return true
+}
+
+// releaseConn frees the slots taken by acquireConn or
+// tryAcquireConn.
+func (d *Downloader) releaseConn() {
+	d.conns.release()
+	d.host.release()
+}
+
+func (d *Downloader) setRetryPolicy(policy *RetryPolicy) {
+	if policy != nil {
+		d.retry = *policy
+	}
+	d.retry.setDefault()
+}
+
+// reportError passes err to the error handler unless it
+// was caused by stopping the part.
+func (d *Downloader) reportError(part *Part, err error) {
+	if part.ctx.Err() != nil {
+		d.Log("%s: stopped: %s", part.hash, err.Error())
+		return
+	}
+	// posted for the download to be aborted right away.
+	d.ev.post(ErrorEvent{EventBase{d.hash}, part.hash, err})
+	if errors.Is(err, ErrRangeNotSupported) || errors.Is(err, ErrRemoteChanged) ||
+		errors.Is(err, ErrResumeNotSupported) {
+		// rest of the parts would fail the same way, a
+		// stream part is the only part of its download.
+		d.abort(err)
+	}
+}
+
+// SetSpeedLimit caps the download speed to bps bytes per
+// second, 0 removes the limit. It takes effect immediately
+// on a running download.
+func (d *Downloader) SetSpeedLimit(bps int64) {
+	d.limiter.SetRate(bps)
+}
+
+// GetSpeedLimit returns the speed limit of the download in
+// bytes per second, 0 if there's no limit.
+func (d *Downloader) GetSpeedLimit() int64 {
+	return d.limiter.Rate()
+}
+
+func (d *Downloader) limiters() []*RateLimiter {
+	if d.shared == nil {
+		return []*RateLimiter{d.limiter}
+	}
+	return []*RateLimiter{d.limiter, d.shared}
+}
+
 func (d *Downloader) GetFileName() string {
 	return d.fileName
 }
@@ -522,6 +1238,10 @@ func (d *Downloader) GetSavePath() (svPath string) {
 	return
 }
 
+func (d *Downloader) getStagingPath() string {
+	return d.dlPath + "warp.dl"
+}
+
 func (d *Downloader) GetContentLength() ContentLength {
 	return d.contentLength
 }
@@ -537,7 +1257,7 @@ func (d *Downloader) GetContentLengthAsString() string {
 // NumConnections returns the number of connections
 // running currently.
 func (d *Downloader) NumConnections() int {
-	return d.numConn
+	return d.conns.count()
 }
 
 // Log adds the provided string to download's log file.
@@ -561,9 +1281,9 @@ func (d *Downloader) setContentLength(cl int64) error {
 	switch cl {
 	case 0:
 		return ErrContentLengthInvalid
-	case -1:
-		return ErrContentLengthNotImplemented
 	default:
+		// content length of -1 marks content of unknown
+		// size, which is downloaded as a stream.
 		d.contentLength = ContentLength(cl)
 		return nil
 	}
@@ -577,6 +1297,21 @@ func (d *Downloader) setFileName(r *http.Request, h *http.Header) {
 	d.fileName = parseFileName(r, cd)
 }
 
+// setServerChecksums adds the checksums sent by the server to
+// the expected checksums, unless they were provided already.
+func (d *Downloader) setServerChecksums(resp *http.Response) {
+	// digests of encoded content don't match the file.
+	if d.ignoreServerChecksums || resp.Uncompressed || resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	for _, sum := range parseChecksums(resp.Header) {
+		if hasChecksum(d.checksums, sum.Algorithm) {
+			continue
+		}
+		d.checksums = append(d.checksums, sum)
+	}
+}
+
 func (d *Downloader) setHash() {
 	buf := make([]byte, 4)
 	rand.Read(buf)
@@ -584,9 +1319,11 @@ func (d *Downloader) setHash() {
 }
 
 func (d *Downloader) setupDlPath() (err error) {
-	dlpath := fmt.Sprintf(
-		"%s/%s/", DlDataDir, d.hash,
-	)
+	err = os.MkdirAll(d.cfg.DataDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+	dlpath := d.cfg.dataPath(d.hash)
 	err = os.Mkdir(dlpath, os.ModePerm)
 	if err != nil {
 		return
@@ -596,8 +1333,14 @@ func (d *Downloader) setupDlPath() (err error) {
 }
 
 func (d *Downloader) setupLogger() (err error) {
+	if d.cfg.LogDir != "" {
+		err = os.MkdirAll(d.cfg.LogDir, os.ModePerm)
+		if err != nil {
+			return
+		}
+	}
 	d.lw, err = os.OpenFile(
-		d.dlPath+"logs.txt",
+		d.cfg.logPath(d.hash),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0666,
 	)
@@ -637,9 +1380,64 @@ func (d *Downloader) fetchInfo() (err error) {
 		return
 	}
 	d.setFileName(resp.Request, &h)
+	d.setServerChecksums(resp)
+	d.vd = newValidator(h)
 	return d.prepareDownloader()
 }
 
+// checkRemote probes the remote file and returns ErrRemoteChanged
+// if it has changed since the download began.
+func (d *Downloader) checkRemote() (err error) {
+	if d.vd.empty() {
+		return
+	}
+	resp, err := d.makeRequest(http.MethodGet, Header{"Range", "bytes=0-0"})
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newStatusError(resp)
+	}
+	if d.vd.changed(resp, false) {
+		err = ErrRemoteChanged
+	}
+	return
+}
+
+// reset prepares the download to be restarted from scratch
+// for the current version of the remote file, removing the
+// bytes downloaded so far. Expected checksums are replaced
+// by the ones sent by the server for the current version.
+func (d *Downloader) reset(parts map[int64]*ItemPart) (err error) {
+	d.Log("Remote file has changed, restarting download...")
+	for _, part := range parts {
+		os.Remove(getFileName(d.dlPath, part.Hash))
+	}
+	err = os.Remove(d.getStagingPath())
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	d.checksums = nil
+	return d.prepareStart()
+}
+
+// prepareStart fetches the info of the remote file for Resume
+// to download it from scratch.
+func (d *Downloader) prepareStart() (err error) {
+	err = d.fetchInfo()
+	if err != nil {
+		return
+	}
+	d.dg, err = newDigester(d.checksums)
+	if err != nil {
+		return
+	}
+	d.capBaseParts()
+	d.restart = true
+	return
+}
+
 func (d *Downloader) makeRequest(method string, hdrs ...Header) (*http.Response, error) {
 	req, err := http.NewRequest(method, d.url, nil)
 	if err != nil {
@@ -654,6 +1452,11 @@ func (d *Downloader) makeRequest(method string, hdrs ...Header) (*http.Response,
 }
 
 func (d *Downloader) prepareDownloader() (err error) {
+	d.numBaseParts = 1
+	if d.contentLength.IsUnknown() {
+		// content of unknown size can't be segmented.
+		return
+	}
 	resp, er := d.makeRequest(
 		http.MethodGet,
 		Header{
@@ -667,7 +1470,13 @@ func (d *Downloader) prepareDownloader() (err error) {
 		err = er
 		return
 	}
-	d.numBaseParts = 1
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		// server ignored the range, the file can only be
+		// downloaded over a single connection.
+		d.noRange = true
+		return
+	}
 	if !d.force && resp.Header.Get("Accept-Ranges") == "" {
 		return
 	}
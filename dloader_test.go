@@ -0,0 +1,584 @@
+package warplib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rangeHandler serves data honoring range requests, sleeping for
+// delay after every 16KB written.
+func rangeHandler(data []byte, delay time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, end := 0, len(data)-1
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if rg := r.Header.Get("Range"); rg != "" {
+			bounds := strings.SplitN(strings.TrimPrefix(rg, "bytes="), "-", 2)
+			start, _ = strconv.Atoi(bounds[0])
+			if bounds[1] != "" {
+				end, _ = strconv.Atoi(bounds[1])
+			}
+			if end >= len(data) {
+				end = len(data) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		}
+		for off := start; off <= end; off += 16 * 1024 {
+			n := 16 * 1024
+			if off+n > end+1 {
+				n = end + 1 - off
+			}
+			if _, err := w.Write(data[off : off+n]); err != nil {
+				return
+			}
+			time.Sleep(delay)
+		}
+	}
+}
+
+func newRangeServer(t *testing.T, data []byte, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(rangeHandler(data, delay))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// connCounter is a transport tracking the peak number of
+// requests in flight, a request is in flight till its body
+// is closed.
+type connCounter struct {
+	n, peak atomic.Int64
+}
+
+func (c *connCounter) RoundTrip(r *http.Request) (*http.Response, error) {
+	n := c.n.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil {
+		c.n.Add(-1)
+		return nil, err
+	}
+	resp.Body = &countedBody{ReadCloser: resp.Body, c: c}
+	return resp, nil
+}
+
+type countedBody struct {
+	io.ReadCloser
+	c    *connCounter
+	once sync.Once
+}
+
+func (b *countedBody) Close() error {
+	b.once.Do(func() { b.c.n.Add(-1) })
+	return b.ReadCloser.Close()
+}
+
+// TestDownloader_split downloads from a slow server for parts to
+// be respawned and merged concurrently, it's meant to be run with
+// the race detector.
+func TestDownloader_split(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	tests := []struct {
+		name     string
+		maxConn  int
+		maxParts int
+		direct   bool
+		coalesce bool
+	}{
+		{"respawn", 8, 0, false, false},
+		{"respawn direct", 8, 0, true, false},
+		{"coalesced progress", 8, 0, false, true},
+		{"max parts", 8, 3, false, false},
+		{"single connection", 1, 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRangeServer(t, data, 15*time.Millisecond)
+			cc := &connCounter{}
+			var respawns, spawns atomic.Int64
+			var nread atomic.Int64
+			d, err := NewDownloader(&http.Client{Transport: cc}, srv.URL+"/file.bin", &DownloaderOpts{
+				Config:            &Config{ConfigDir: t.TempDir()},
+				DownloadDirectory: t.TempDir(),
+				NumBaseParts:      1,
+				MaxConnections:    tt.maxConn,
+				MaxSegments:       tt.maxParts,
+				DirectWrite:       tt.direct,
+				CoalesceProgress:  tt.coalesce,
+				Handlers: &Handlers{
+					SpawnPartHandler: func(string, int64, int64) { spawns.Add(1) },
+					RespawnPartHandler: func(string, int64, int64, int64) {
+						respawns.Add(1)
+					},
+					DownloadProgressHandler: func(_ string, n int) { nread.Add(int64(n)) },
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// info of the file is fetched over two requests.
+			cc.peak.Store(cc.n.Load())
+			if err = d.Start(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(d.GetSavePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("downloaded file differs from the served one (%d of %d bytes)", len(got), len(data))
+			}
+			if nread.Load() != int64(len(data)) {
+				t.Errorf("progress = %d bytes, want %d", nread.Load(), len(data))
+			}
+			if tt.maxConn > 1 && respawns.Load() == 0 {
+				t.Errorf("no part was respawned")
+			}
+			if peak := cc.peak.Load(); peak > int64(tt.maxConn) {
+				t.Errorf("peak connections = %d, want at most %d", peak, tt.maxConn)
+			}
+			if tt.maxParts != 0 && spawns.Load() > int64(tt.maxParts) {
+				t.Errorf("spawned %d parts, want at most %d", spawns.Load(), tt.maxParts)
+			}
+			if n := d.NumConnections(); n != 0 {
+				t.Errorf("NumConnections() = %d after the download, want 0", n)
+			}
+		})
+	}
+}
+
+func TestManager_download(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	srv := newRangeServer(t, data, 5*time.Millisecond)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetFlushInterval(10 * time.Millisecond)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	item := m.GetItem(d.hash)
+	if item.GetState() != ItemStateCompleted || item.Downloaded != item.TotalSize {
+		t.Errorf("item is %s with %d of %d bytes, want completed", item.GetState(), item.Downloaded, item.TotalSize)
+	}
+	got, err := os.ReadFile(d.GetSavePath())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("downloaded file differs from the served one: %v", err)
+	}
+}
+
+// TestDownloader_stopResume stops a download midway and resumes
+// it through the manager, the file has to match the served one.
+func TestDownloader_stopResume(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	tests := []struct {
+		name   string
+		direct bool
+		cancel bool
+	}{
+		{"stop", false, false},
+		{"stop direct", true, false},
+		{"cancel context", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newRangeServer(t, data, 5*time.Millisecond)
+			cfg := &Config{ConfigDir: t.TempDir()}
+			m, err := NewManager(cfg, NewMemoryStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			var progress atomic.Int64
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var d *Downloader
+			var once sync.Once
+			d, err = NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+				Config:            cfg,
+				DownloadDirectory: t.TempDir(),
+				MaxConnections:    4,
+				DirectWrite:       tt.direct,
+				Handlers: &Handlers{
+					DownloadProgressHandler: func(_ string, n int) {
+						if progress.Add(int64(n)) < 256*1024 {
+							return
+						}
+						once.Do(func() {
+							if tt.cancel {
+								cancel()
+								return
+							}
+							d.Stop()
+						})
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.AddDownload(d, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err = d.StartContext(ctx); err != nil {
+				t.Fatal(err)
+			}
+			item := m.GetItem(d.hash)
+			if s := item.GetState(); s != ItemStatePaused {
+				t.Fatalf("item is %s after stopping, want %s", s, ItemStatePaused)
+			}
+			if _, err = os.Stat(d.GetSavePath()); !os.IsNotExist(err) {
+				t.Fatalf("stopped download is at the save path: %v", err)
+			}
+			// a resume stopped before it starts leaves the
+			// item paused.
+			item, err = m.ResumeDownload(&http.Client{}, d.hash, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			item.Stop()
+			if err = item.Resume(); !errors.Is(err, ErrDownloadStopped) {
+				t.Fatalf("Resume() of stopped download error = %v, want %v", err, ErrDownloadStopped)
+			}
+			if s := item.GetState(); s != ItemStatePaused {
+				t.Fatalf("item is %s after a stopped resume, want %s", s, ItemStatePaused)
+			}
+			item, err = m.ResumeDownload(&http.Client{}, d.hash, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = item.ResumeContext(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if s := item.GetState(); s != ItemStateCompleted {
+				t.Errorf("item is %s after resuming, want %s", s, ItemStateCompleted)
+			}
+			got, err := os.ReadFile(d.GetSavePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("resumed file differs from the served one (%d of %d bytes)", len(got), len(data))
+			}
+		})
+	}
+}
+
+// streamHandler serves data without a Content-Length, honoring
+// ranges from an offset till the end if ranges is set. Requested
+// ranges are appended to got.
+func streamHandler(data []byte, ranges bool, got *[]string, mu *sync.Mutex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if rg := r.Header.Get("Range"); rg != "" {
+			mu.Lock()
+			*got = append(*got, rg)
+			mu.Unlock()
+			if ranges {
+				start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rg, "bytes="), "-"))
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, len(data)-1))
+				w.WriteHeader(http.StatusPartialContent)
+			}
+		}
+		for off := start; off < len(data); off += 16 * 1024 {
+			end := off + 16*1024
+			if end > len(data) {
+				end = len(data)
+			}
+			if _, err := w.Write(data[off:end]); err != nil {
+				return
+			}
+			// flushing makes the response chunked.
+			w.(http.Flusher).Flush()
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+}
+
+func TestDownloader_unknownSize(t *testing.T) {
+	data := make([]byte, MB)
+	rand.Read(data)
+	tests := []struct {
+		name    string
+		ranges  bool
+		wantErr error
+	}{
+		{"resume", true, nil},
+		{"resume not supported", false, ErrResumeNotSupported},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				ranges []string
+			)
+			srv := httptest.NewServer(streamHandler(data, tt.ranges, &ranges, &mu))
+			defer srv.Close()
+			cfg := &Config{ConfigDir: t.TempDir()}
+			m, err := NewManager(cfg, NewMemoryStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			var (
+				progress atomic.Int64
+				once     sync.Once
+				d        *Downloader
+			)
+			d, err = NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+				Config:            cfg,
+				DownloadDirectory: t.TempDir(),
+				Handlers: &Handlers{
+					DownloadProgressHandler: func(_ string, n int) {
+						if progress.Add(int64(n)) >= 256*1024 {
+							once.Do(d.Stop)
+						}
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.GetContentLengthAsInt() != -1 {
+				t.Fatalf("content length = %d, want unknown", d.GetContentLengthAsInt())
+			}
+			if err = m.AddDownload(d, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err = d.Start(); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(d.getStagingPath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			item, err := m.ResumeDownload(&http.Client{}, d.hash, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = item.Resume()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Resume() error = %v, want %v", err, tt.wantErr)
+			}
+			mu.Lock()
+			got := append([]string(nil), ranges...)
+			mu.Unlock()
+			want := []string{fmt.Sprintf("bytes=%d-", fi.Size())}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("requested ranges = %v, want %v", got, want)
+			}
+			if tt.wantErr != nil {
+				if s := item.GetState(); s != ItemStateFailed {
+					t.Errorf("item is %s, want %s", s, ItemStateFailed)
+				}
+				return
+			}
+			if item.TotalSize != ContentLength(len(data)) || item.GetState() != ItemStateCompleted {
+				t.Errorf("item is %s with size %d, want completed with %d", item.GetState(), item.TotalSize, len(data))
+			}
+			b, err := os.ReadFile(d.GetSavePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("downloaded file differs from the served one (%d of %d bytes)", len(b), len(data))
+			}
+		})
+	}
+}
+
+// TestDownloader_merge downloads a file over a fast part followed
+// by a slow one, the fast part has to absorb the slow one once it
+// catches up with it.
+func TestDownloader_merge(t *testing.T) {
+	data := make([]byte, 10*MB)
+	rand.Read(data)
+	half := len(data) / 2
+	fast := rangeHandler(data, 0)
+	slow := rangeHandler(data, 20*time.Millisecond)
+	for _, direct := range []bool{false, true} {
+		t.Run(fmt.Sprintf("direct=%v", direct), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// only the request of the second part is slow.
+				if strings.HasPrefix(r.Header.Get("Range"), fmt.Sprintf("bytes=%d-", half)) {
+					slow(w, r)
+					return
+				}
+				fast(w, r)
+			}))
+			defer srv.Close()
+			cfg := &Config{ConfigDir: t.TempDir()}
+			m, err := NewManager(cfg, NewMemoryStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+			type merge struct {
+				hash, mhash string
+				ioff, foff  int64
+				parts       map[int64]*ItemPart
+			}
+			var (
+				mu     sync.Mutex
+				merges []merge
+				spawns = make(map[int64]string)
+				d      *Downloader
+			)
+			d, err = NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+				Config:            cfg,
+				DownloadDirectory: t.TempDir(),
+				NumBaseParts:      2,
+				MaxConnections:    2,
+				// no part is split.
+				MaxSegments: 2,
+				DirectWrite: direct,
+				Handlers: &Handlers{
+					SpawnPartHandler: func(hash string, ioff, _ int64) {
+						mu.Lock()
+						spawns[ioff] = hash
+						mu.Unlock()
+					},
+					MergePartHandler: func(hash, mhash string, ioff, foff int64) {
+						// the item is updated before the handlers are called.
+						parts := m.lookupItem(d.hash).copyParts()
+						mu.Lock()
+						merges = append(merges, merge{hash, mhash, ioff, foff, parts})
+						mu.Unlock()
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = m.AddDownload(d, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err = d.Start(); err != nil {
+				t.Fatal(err)
+			}
+			if len(merges) != 1 {
+				t.Fatalf("parts were merged %d times, want 1", len(merges))
+			}
+			mg := merges[0]
+			if mg.hash != spawns[0] || mg.mhash != spawns[int64(half)] {
+				t.Errorf("part %s merged %s, want %s to merge %s", mg.hash, mg.mhash, spawns[0], spawns[int64(half)])
+			}
+			if mg.ioff != 0 || mg.foff != int64(len(data)-1) {
+				t.Errorf("merged part spans %d-%d, want 0-%d", mg.ioff, mg.foff, len(data)-1)
+			}
+			if p := mg.parts[0]; len(mg.parts) != 1 || p == nil || p.Hash != spawns[0] || p.FinalOffset != int64(len(data)-1) {
+				t.Errorf("item parts after the merge = %v, want a single part %s till %d", mg.parts, spawns[0], len(data)-1)
+			}
+			got, err := os.ReadFile(d.GetSavePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("downloaded file differs from the served one")
+			}
+		})
+	}
+}
+
+// TestDownloader_incomplete downloads from a server which keeps
+// failing the second half of the file, the download has to fail
+// once its part gives up instead of being reported as done.
+func TestDownloader_incomplete(t *testing.T) {
+	data := make([]byte, MB)
+	rand.Read(data)
+	serve := rangeHandler(data, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rg := strings.TrimPrefix(r.Header.Get("Range"), "bytes=")
+		if start, _ := strconv.Atoi(strings.SplitN(rg, "-", 2)[0]); start >= len(data)/2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serve(w, r)
+	}))
+	defer srv.Close()
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var failed atomic.Bool
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    2,
+		NumBaseParts:      2,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    2,
+			InitialBackoff: time.Millisecond,
+		},
+		Handlers: &Handlers{
+			ErrorHandler: func(hash string, err error) {
+				if hash == MAIN_HASH && errors.Is(err, ErrDownloadIncomplete) {
+					failed.Store(true)
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = d.Start()
+	var ie *IncompleteError
+	if !errors.As(err, &ie) || !errors.Is(err, ErrDownloadIncomplete) {
+		t.Fatalf("Start() error = %v, want %v", err, ErrDownloadIncomplete)
+	}
+	if ie.Expected != int64(len(data)) || ie.Downloaded >= ie.Expected {
+		t.Errorf("Start() error = %v, want less than %d bytes downloaded", err, len(data))
+	}
+	if !failed.Load() {
+		t.Error("no error was emitted for the incomplete download")
+	}
+	item := m.GetItem(d.hash)
+	if item.GetState() != ItemStateFailed || item.LastError != err.Error() {
+		t.Errorf("item is %s with error %q, want failed with %q", item.GetState(), item.LastError, err)
+	}
+}
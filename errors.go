@@ -6,8 +6,28 @@ var (
 	ErrContentLengthInvalid        = errors.New("content length is invalid")
 	ErrContentLengthNotImplemented = errors.New("unknown size downloads not implemented yet")
 	ErrNotSupported                = errors.New("file you're trying to download is not supported yet")
+	ErrResumeNotSupported          = errors.New("server doesn't support resuming this download")
+	ErrRangeNotSupported           = errors.New("server doesn't honor range requests")
+	ErrRemoteChanged               = errors.New("remote file has changed since the download began")
+	ErrDownloadStopped             = errors.New("download was stopped before being started")
+	ErrDownloadIncomplete          = errors.New("download is missing bytes")
+	ErrFinalizeSizeMismatch        = errors.New("size of the moved file doesn't match the downloaded file")
+	ErrChecksumMismatch            = errors.New("checksum of the downloaded file doesn't match")
+	ErrChecksumNotSupported        = errors.New("checksum algorithm is not supported")
+	ErrInvalidTimeOfDay            = errors.New("time of day must be in the hh:mm format")
+	ErrDatabaseCorrupt             = errors.New("manager database is corrupt")
+	ErrDatabaseVersion             = errors.New("manager database was written by a newer version")
+	ErrManagerLocked               = errors.New("manager database is in use by another process")
+	ErrReadOnly                    = errors.New("manager database is opened read-only")
+	ErrConfigMismatch              = errors.New("config of the download doesn't match the config of the manager")
+	ErrDownloadNotSetUp            = errors.New("download was created with SkipSetup")
 
 	ErrDownloadNotFound = errors.New("Item you are trying to download is not found")
 
 	ErrFlushHashNotFound = errors.New("Item you are trying to flush is not found")
+
+	ErrDownloadComplete  = errors.New("Item you are trying to queue is already downloaded")
+	ErrDownloadQueued    = errors.New("Item you are trying to queue is already queued")
+	ErrDownloadNotQueued = errors.New("Item is not queued")
+	ErrInvalidTransition = errors.New("Item can't move to this state")
 )
@@ -0,0 +1,336 @@
+package warplib
+
+import "time"
+
+// Event is an event of a download, it's one of the *Event types
+// of this package. Part is the hash of the part an event is
+// about, MAIN_HASH stands for the download as a whole.
+type Event interface {
+	// DownloadHash returns the hash of the download, which is
+	// the hash of its item in a manager.
+	DownloadHash() string
+}
+
+// EventBase holds the hash of the download an event is about,
+// it's embedded in every event.
+type EventBase struct {
+	Hash string
+}
+
+func (e EventBase) DownloadHash() string {
+	return e.Hash
+}
+
+// PartSpawnedEvent is sent once a part starts downloading the
+// bytes from Ioff till Foff, Foff is -1 for content of unknown
+// size.
+type PartSpawnedEvent struct {
+	EventBase
+	Part       string
+	Ioff, Foff int64
+}
+
+// PartRespawnedEvent is sent once a slow part is split, the part
+// keeps downloading from IoffNew till FoffNew while a new part
+// takes over the rest.
+type PartRespawnedEvent struct {
+	EventBase
+	Part             string
+	Ioff             int64
+	IoffNew, FoffNew int64
+}
+
+// PartMergedEvent is sent once the part at Ioff absorbs the
+// part Merged next to it, extending till Foff.
+type PartMergedEvent struct {
+	EventBase
+	Part, Merged string
+	Ioff, Foff   int64
+}
+
+// ProgressEvent is sent as a part downloads Bytes.
+type ProgressEvent struct {
+	EventBase
+	Part  string
+	Bytes int
+}
+
+// ResumeProgressEvent is sent as a resumed part goes through
+// the Bytes it downloaded before.
+type ResumeProgressEvent struct {
+	EventBase
+	Part  string
+	Bytes int
+}
+
+// CompileStartedEvent is sent once a part starts being copied
+// into the download file.
+type CompileStartedEvent struct {
+	EventBase
+	Part string
+}
+
+// CompileProgressEvent is sent as Bytes of a part are copied
+// into the download file.
+type CompileProgressEvent struct {
+	EventBase
+	Part  string
+	Bytes int
+}
+
+// CompileSkippedEvent is sent for the parts already compiled
+// when the download is resumed.
+type CompileSkippedEvent struct {
+	EventBase
+	Part string
+	Size int64
+}
+
+// CompileCompletedEvent is sent once a part of Size bytes is in
+// the download file.
+type CompileCompletedEvent struct {
+	EventBase
+	Part string
+	Size int64
+}
+
+// CompletedEvent is sent once a part has downloaded its Size
+// bytes, and once the download is complete with Part being
+// MAIN_HASH.
+type CompletedEvent struct {
+	EventBase
+	Part string
+	Size int64
+}
+
+// StoppedEvent is sent once the download is stopped, Err is
+// the error it was aborted with if any.
+type StoppedEvent struct {
+	EventBase
+	Err error
+}
+
+// FinalizeProgressEvent is sent as Bytes of the downloaded file
+// are moved to the save path.
+type FinalizeProgressEvent struct {
+	EventBase
+	Bytes int
+}
+
+// VerifiedEvent is sent for every checksum of the download once
+// it's verified, Err is a *ChecksumError if the digests don't
+// match.
+type VerifiedEvent struct {
+	EventBase
+	Checksum Checksum
+	Err      error
+}
+
+// ErrorEvent is sent for the errors of the parts and the
+// download.
+type ErrorEvent struct {
+	EventBase
+	Part string
+	Err  error
+}
+
+// RetryEvent is sent before a failed part is retried after
+// Delay, Attempt is the number of the retry.
+type RetryEvent struct {
+	EventBase
+	Part    string
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+// StateChangedEvent is sent once the download moves to State,
+// Err is the error it failed with if any.
+type StateChangedEvent struct {
+	EventBase
+	State ItemState
+	Err   error
+}
+
+// handle calls the handler of the event, which is how the
+// handlers are fed from the events of a download.
+func (h *Handlers) handle(ev Event) {
+	switch ev := ev.(type) {
+	case PartSpawnedEvent:
+		h.SpawnPartHandler(ev.Part, ev.Ioff, ev.Foff)
+	case PartRespawnedEvent:
+		h.RespawnPartHandler(ev.Part, ev.Ioff, ev.IoffNew, ev.FoffNew)
+	case PartMergedEvent:
+		h.MergePartHandler(ev.Part, ev.Merged, ev.Ioff, ev.Foff)
+	case ProgressEvent:
+		h.DownloadProgressHandler(ev.Part, ev.Bytes)
+	case ResumeProgressEvent:
+		h.ResumeProgressHandler(ev.Part, ev.Bytes)
+	case CompileStartedEvent:
+		h.CompileStartHandler(ev.Part)
+	case CompileProgressEvent:
+		h.CompileProgressHandler(ev.Part, ev.Bytes)
+	case CompileSkippedEvent:
+		h.CompileSkippedHandler(ev.Part, ev.Size)
+	case CompileCompletedEvent:
+		h.CompileCompleteHandler(ev.Part, ev.Size)
+	case CompletedEvent:
+		h.DownloadCompleteHandler(ev.Part, ev.Size)
+	case StoppedEvent:
+		h.DownloadStoppedHandler()
+	case FinalizeProgressEvent:
+		h.FinalizeProgressHandler(MAIN_HASH, ev.Bytes)
+	case VerifiedEvent:
+		h.VerifyHandler(ev.Checksum, ev.Err)
+	case ErrorEvent:
+		h.ErrorHandler(ev.Part, ev.Err)
+	case RetryEvent:
+		h.RetryHandler(ev.Part, ev.Attempt, ev.Delay, ev.Err)
+	case StateChangedEvent:
+		if ev.State == ItemStateVerifying {
+			h.VerifyStartHandler(MAIN_HASH)
+		}
+	}
+}
+
+// Events returns the events of the download, the channel is
+// closed once Start (or Resume) returns. Events are sent after
+// the handlers are called and the download waits for them to
+// be received, so the channel has to be drained. Once the
+// download is stopped, events which don't fit in the channel
+// are dropped.
+func (d *Downloader) Events() <-chan Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.evch == nil {
+		d.evch = make(chan Event, DEF_EVENT_QUEUE_SIZE)
+		if d.evdone {
+			close(d.evch)
+		}
+	}
+	return d.evch
+}
+
+// listen makes l get the events of the download before the
+// handlers, it has to be called before the download starts.
+func (d *Downloader) listen(l func(Event)) {
+	d.listeners = append(d.listeners, l)
+}
+
+// emit passes the event to the listeners, the handlers and the
+// channel returned by Events, in that order.
+func (d *Downloader) emit(ev Event) {
+	for _, l := range d.listeners {
+		l(ev)
+	}
+	d.handlers.handle(ev)
+	d.mu.Lock()
+	ch := d.evch
+	if d.evdone {
+		ch = nil
+	}
+	d.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	// events are delivered as long as there's room once the
+	// download is stopped.
+	select {
+	case ch <- ev:
+		return
+	default:
+	}
+	select {
+	case ch <- ev:
+	case <-d.ctx.Done():
+	}
+}
+
+func (d *Downloader) emitState(s ItemState, err error) {
+	d.emit(StateChangedEvent{EventBase{d.hash}, s, err})
+}
+
+// closeEvents closes the channel returned by Events once the
+// download has returned.
+func (d *Downloader) closeEvents() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evdone = true
+	if d.evch != nil {
+		close(d.evch)
+	}
+}
+
+// Events returns the events of the downloads of the manager and
+// the state changes of its items, the channel is closed once the
+// manager is closed. Events are sent after the items are updated
+// and, like with Downloader.Events, the downloads wait for them
+// to be received so the channel has to be drained.
+func (m *Manager) Events() <-chan Event {
+	m.evmu.Lock()
+	defer m.evmu.Unlock()
+	if m.evch != nil {
+		return m.evch
+	}
+	m.evch = make(chan Event, DEF_EVENT_QUEUE_SIZE)
+	if m.evclosed {
+		close(m.evch)
+		return m.evch
+	}
+	m.ev = newDispatcher(m.deliver, DEF_EVENT_QUEUE_SIZE, false)
+	return m.evch
+}
+
+// emit queues the event for the channel returned by Events, if
+// it has been created.
+func (m *Manager) emit(ev Event) {
+	m.evmu.Lock()
+	e := m.ev
+	m.evmu.Unlock()
+	if e == nil {
+		return
+	}
+	// states are changed with the locks of the manager
+	// held, which the receiver may be waiting for.
+	if _, ok := ev.(StateChangedEvent); ok {
+		e.post(ev)
+		return
+	}
+	e.send(ev)
+}
+
+func (m *Manager) deliver(ev Event) {
+	// events are delivered as long as there's room once the
+	// manager is closed.
+	select {
+	case m.evch <- ev:
+		return
+	default:
+	}
+	select {
+	case m.evch <- ev:
+	case <-m.evstop:
+	}
+}
+
+func (m *Manager) stateChanged(hash string, s ItemState, err error) {
+	m.emit(StateChangedEvent{EventBase{hash}, s, err})
+}
+
+// closeEvents closes the channel returned by Events, pending
+// events which don't fit in it are dropped.
+func (m *Manager) closeEvents() {
+	m.evmu.Lock()
+	if m.evclosed {
+		m.evmu.Unlock()
+		return
+	}
+	m.evclosed = true
+	close(m.evstop)
+	e := m.ev
+	m.evmu.Unlock()
+	if e != nil {
+		e.close()
+		close(m.evch)
+	}
+}
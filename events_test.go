@@ -0,0 +1,206 @@
+package warplib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloader_Events(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	srv := newRangeServer(t, data, time.Millisecond)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan []Event)
+	ch := d.Events()
+	go func() {
+		var evs []Event
+		for ev := range ch {
+			evs = append(evs, ev)
+		}
+		done <- evs
+	}()
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	evs := <-done
+	if len(evs) < 3 {
+		t.Fatalf("got %d events, want at least 3", len(evs))
+	}
+	want := StateChangedEvent{EventBase{d.hash}, ItemStateRunning, nil}
+	if evs[0] != want {
+		t.Errorf("first event is %#v, want %#v", evs[0], want)
+	}
+	tail := evs[len(evs)-2:]
+	wantTail := []Event{
+		CompletedEvent{EventBase{d.hash}, MAIN_HASH, int64(len(data))},
+		StateChangedEvent{EventBase{d.hash}, ItemStateCompleted, nil},
+	}
+	if !reflect.DeepEqual(tail, wantTail) {
+		t.Errorf("last events are %#v, want %#v", tail, wantTail)
+	}
+	var n int
+	for _, ev := range evs {
+		if ev, ok := ev.(ProgressEvent); ok {
+			n += ev.Bytes
+		}
+	}
+	if n != len(data) {
+		t.Errorf("progress events add up to %d bytes, want %d", n, len(data))
+	}
+	if _, ok := <-d.Events(); ok {
+		t.Error("events of a returned download aren't closed")
+	}
+}
+
+func TestManager_Events(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	srv := newRangeServer(t, data, time.Millisecond)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := m.Events()
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	var got []string
+	for ev := range ch {
+		if ev.DownloadHash() != d.hash {
+			t.Errorf("event of download %q, want %q", ev.DownloadHash(), d.hash)
+		}
+		switch ev := ev.(type) {
+		case StateChangedEvent:
+			got = append(got, string(ev.State))
+		case CompletedEvent:
+			if ev.Part == MAIN_HASH {
+				got = append(got, "done")
+			}
+		}
+	}
+	want := []string{string(ItemStateRunning), "done", string(ItemStateCompleted)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
+
+// TestDownloader_eventOrder checks that the events of the parts
+// are emitted one at a time in the order the parts sent them.
+func TestDownloader_eventOrder(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	srv := newRangeServer(t, data, 15*time.Millisecond)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    8,
+		NumBaseParts:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		inflight atomic.Int32
+		spawned  = make(map[string]bool)
+		compiled = make(map[string]bool)
+		errs     []string
+	)
+	d.listen(func(ev Event) {
+		if inflight.Add(1) != 1 {
+			errs = append(errs, fmt.Sprintf("%T emitted concurrently", ev))
+		}
+		defer inflight.Add(-1)
+		var part string
+		switch ev := ev.(type) {
+		case PartSpawnedEvent:
+			spawned[ev.Part] = true
+			return
+		case ProgressEvent:
+			part = ev.Part
+		case CompileProgressEvent:
+			part = ev.Part
+		case PartRespawnedEvent:
+			part = ev.Part
+		case CompileCompletedEvent:
+			part = ev.Part
+			compiled[part] = true
+			return
+		default:
+			return
+		}
+		if !spawned[part] || compiled[part] {
+			errs = append(errs, fmt.Sprintf("%T of part %s outside of its lifetime", ev, part))
+		}
+	})
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range errs {
+		t.Error(e)
+	}
+	if len(spawned) < 2 {
+		t.Errorf("%d parts spawned, want the slow part to be split", len(spawned))
+	}
+}
+
+// TestDownloader_Events_notDrained stops a download whose events
+// aren't received, Stop has to unblock it.
+func TestDownloader_Events_notDrained(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	srv := newRangeServer(t, data, 5*time.Millisecond)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// small chunks for the events to outnumber the room of
+	// the channel.
+	d.chunk = 1024
+	ch := d.Events()
+	started := make(chan error, 1)
+	go func() { started <- d.Start() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ch) != cap(ch) {
+		if time.Now().After(deadline) {
+			t.Fatal("events channel wasn't filled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.Stop()
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() didn't return after Stop()")
+	}
+}
@@ -0,0 +1,59 @@
+package warplib
+
+import "time"
+
+// SetFlushInterval sets how often the progress of the downloads
+// is saved to the store, d <= 0 saves it on every change. Other
+// changes, such as new parts, compiled parts and completed or
+// stopped downloads, are always saved right away.
+func (m *Manager) SetFlushInterval(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	m.dmu.Lock()
+	m.flushInterval = d
+	m.dmu.Unlock()
+}
+
+// markDirty schedules the item to be saved to the store once the
+// flush interval elapses.
+func (m *Manager) markDirty(item *Item) {
+	m.dmu.Lock()
+	if m.flushInterval == 0 {
+		m.dmu.Unlock()
+		m.put(item)
+		return
+	}
+	m.dirty[item.Hash] = item
+	if m.flushTimer == nil {
+		m.flushTimer = time.AfterFunc(m.flushInterval, func() { m.flushDirty() })
+	}
+	m.dmu.Unlock()
+}
+
+// clean drops the pending save of the item with hash.
+func (m *Manager) clean(hash string) {
+	m.dmu.Lock()
+	defer m.dmu.Unlock()
+	delete(m.dirty, hash)
+}
+
+// flushDirty saves the items whose progress has changed since
+// they were last saved.
+func (m *Manager) flushDirty() (err error) {
+	m.dmu.Lock()
+	dirty := m.dirty
+	m.dirty = make(map[string]*Item)
+	if m.flushTimer != nil {
+		m.flushTimer.Stop()
+		m.flushTimer = nil
+	}
+	m.dmu.Unlock()
+	for _, item := range dirty {
+		er := m.put(item)
+		if err == nil {
+			err = er
+		}
+	}
+	return
+}
@@ -0,0 +1,159 @@
+package warplib
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// countingStore counts the items saved to it.
+type countingStore struct {
+	*MemoryStore
+	puts map[string]int
+}
+
+func (s *countingStore) Put(item *Item) error {
+	s.puts[item.Hash]++
+	return s.MemoryStore.Put(item)
+}
+
+func TestManager_markDirty(t *testing.T) {
+	store := &countingStore{NewMemoryStore(), make(map[string]int)}
+	m, err := NewManager(&Config{ConfigDir: t.TempDir()}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetFlushInterval(time.Hour)
+	a, b := &Item{Hash: "a"}, &Item{Hash: "b"}
+	m.mapItem(a)
+	m.mapItem(b)
+	for i := 0; i < 100; i++ {
+		m.markDirty(a)
+		m.markDirty(b)
+	}
+	if len(store.puts) != 0 {
+		t.Fatalf("progress saved before the flush interval: %v", store.puts)
+	}
+	m.UpdateItem(a)
+	if store.puts["a"] != 1 {
+		t.Fatalf("UpdateItem() saved item %d times, want 1", store.puts["a"])
+	}
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts["a"] != 1 || store.puts["b"] != 1 {
+		t.Fatalf("Close() saved items %v, want each once", store.puts)
+	}
+	m.SetFlushInterval(0)
+	m.markDirty(b)
+	if store.puts["b"] != 2 {
+		t.Fatalf("progress not saved right away without a flush interval")
+	}
+}
+
+func TestManager_markDirty_removed(t *testing.T) {
+	store := &countingStore{NewMemoryStore(), make(map[string]int)}
+	m, err := NewManager(&Config{ConfigDir: t.TempDir()}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetFlushInterval(time.Hour)
+	item := &Item{Hash: "a", mu: m.mu}
+	m.UpdateItem(item)
+	m.markDirty(item)
+	if err = m.RemoveDownload(item.Hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a flush which took the item before it was removed.
+	m.dmu.Lock()
+	m.dirty[item.Hash] = item
+	m.dmu.Unlock()
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store.puts["a"] != 1 {
+		t.Errorf("removed item saved %d times, want 1", store.puts["a"])
+	}
+	if items, _ := store.List(); len(items) != 0 {
+		t.Errorf("removed item was saved again: %v", items)
+	}
+}
+
+func TestManager_compileSaved(t *testing.T) {
+	srv := newRangeServer(t, bytes.Repeat([]byte("warp"), 1024), 0)
+	store := &countingStore{NewMemoryStore(), make(map[string]int)}
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetFlushInterval(time.Hour)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	item := m.GetItem(d.hash)
+	item.addPart("p", 0, 4096)
+	puts := store.puts[d.hash]
+	d.emit(CompileCompletedEvent{EventBase{d.hash}, "p", 4096})
+	if store.puts[d.hash] != puts+1 {
+		t.Errorf("compiled part saved %d times, want 1", store.puts[d.hash]-puts)
+	}
+	if _, part := item.getPart("p"); part == nil || !part.Compiled {
+		t.Errorf("part is %+v, want compiled", part)
+	}
+}
+
+// blockingStore blocks in Put till release is closed.
+type blockingStore struct {
+	*MemoryStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) Put(item *Item) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.MemoryStore.Put(item)
+}
+
+// TestManager_put saves an item while it's being downloaded, the
+// download isn't held up by the store and the store gets a copy.
+func TestManager_put(t *testing.T) {
+	store := &blockingStore{NewMemoryStore(), make(chan struct{}, 1), make(chan struct{})}
+	m, err := NewManager(&Config{ConfigDir: t.TempDir()}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &Item{Hash: "a", TotalSize: 10, Parts: make(map[int64]*ItemPart), memPart: make(map[string]int64), mu: m.mu}
+	put := make(chan struct{})
+	go func() {
+		m.UpdateItem(item)
+		close(put)
+	}()
+	<-store.entered
+	progressed := make(chan struct{})
+	go func() {
+		item.addProgress("p", 5)
+		close(progressed)
+	}()
+	select {
+	case <-progressed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress is held up while the store writes the item")
+	}
+	close(store.release)
+	<-put
+	items, _ := store.List()
+	if len(items) != 1 || items[0] == item || items[0].Downloaded != 0 {
+		t.Errorf("store got %+v, want a copy of the item before the progress", items)
+	}
+}
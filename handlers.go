@@ -1,31 +1,53 @@
 package warplib
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 type (
 	ErrorHandlerFunc            func(hash string, err error)
+	RetryHandlerFunc            func(hash string, attempt int, delay time.Duration, err error)
 	SpawnPartHandlerFunc        func(hash string, ioff, foff int64)
 	RespawnPartHandlerFunc      func(hash string, partIoff, ioffNew, foffNew int64)
+	MergePartHandlerFunc        func(hash, mhash string, partIoff, foffNew int64)
 	DownloadProgressHandlerFunc func(hash string, nread int)
 	ResumeProgressHandlerFunc   func(hash string, nread int)
 	DownloadCompleteHandlerFunc func(hash string, tread int64)
+	DownloadStoppedHandlerFunc  func()
 	CompileStartHandlerFunc     func(hash string)
 	CompileProgressHandlerFunc  func(hash string, nread int)
 	CompileSkippedHandlerFunc   func(hash string, tread int64)
 	CompileCompleteHandlerFunc  func(hash string, tread int64)
+	FinalizeProgressHandlerFunc func(hash string, nread int)
+	VerifyStartHandlerFunc      func(hash string)
+	VerifyHandlerFunc           func(sum Checksum, err error)
 )
 
 type Handlers struct {
 	SpawnPartHandler        SpawnPartHandlerFunc
 	RespawnPartHandler      RespawnPartHandlerFunc
+	MergePartHandler        MergePartHandlerFunc
 	DownloadProgressHandler DownloadProgressHandlerFunc
 	ResumeProgressHandler   ResumeProgressHandlerFunc
 	ErrorHandler            ErrorHandlerFunc
+	// RetryHandler is called before a failed part is retried
+	// after delay, attempt is the number of the retry.
+	RetryHandler            RetryHandlerFunc
 	DownloadCompleteHandler DownloadCompleteHandlerFunc
+	DownloadStoppedHandler  DownloadStoppedHandlerFunc
 	CompileStartHandler     CompileStartHandlerFunc
 	CompileProgressHandler  CompileProgressHandlerFunc
 	CompileSkippedHandler   CompileSkippedHandlerFunc
 	CompileCompleteHandler  CompileCompleteHandlerFunc
+	FinalizeProgressHandler FinalizeProgressHandlerFunc
+	// VerifyStartHandler is called once the download
+	// starts being verified against its checksums.
+	VerifyStartHandler VerifyStartHandlerFunc
+	// VerifyHandler is called for every checksum of the
+	// download once it's verified, err is a *ChecksumError
+	// if the digests don't match.
+	VerifyHandler VerifyHandlerFunc
 }
 
 func (h *Handlers) setDefault(l *log.Logger) {
@@ -35,15 +57,24 @@ func (h *Handlers) setDefault(l *log.Logger) {
 	if h.RespawnPartHandler == nil {
 		h.RespawnPartHandler = func(hash string, partIoff, ioffNew, foffNew int64) {}
 	}
+	if h.MergePartHandler == nil {
+		h.MergePartHandler = func(hash, mhash string, partIoff, foffNew int64) {}
+	}
 	if h.DownloadProgressHandler == nil {
 		h.DownloadProgressHandler = func(hash string, nread int) {}
 	}
 	if h.ResumeProgressHandler == nil {
 		h.ResumeProgressHandler = func(hash string, nread int) {}
 	}
+	if h.RetryHandler == nil {
+		h.RetryHandler = func(hash string, attempt int, delay time.Duration, err error) {}
+	}
 	if h.DownloadCompleteHandler == nil {
 		h.DownloadCompleteHandler = func(hash string, tread int64) {}
 	}
+	if h.DownloadStoppedHandler == nil {
+		h.DownloadStoppedHandler = func() {}
+	}
 	if h.CompileStartHandler == nil {
 		h.CompileStartHandler = func(hash string) {}
 	}
@@ -56,6 +87,15 @@ func (h *Handlers) setDefault(l *log.Logger) {
 	if h.CompileCompleteHandler == nil {
 		h.CompileCompleteHandler = func(hash string, tread int64) {}
 	}
+	if h.FinalizeProgressHandler == nil {
+		h.FinalizeProgressHandler = func(hash string, nread int) {}
+	}
+	if h.VerifyStartHandler == nil {
+		h.VerifyStartHandler = func(hash string) {}
+	}
+	if h.VerifyHandler == nil {
+		h.VerifyHandler = func(sum Checksum, err error) {}
+	}
 	if h.ErrorHandler == nil {
 		h.ErrorHandler = func(hash string, err error) {
 			wlog(l, "%s: Error: %s", hash, err.Error())
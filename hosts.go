@@ -0,0 +1,130 @@
+package warplib
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// HostLimits counts the connections the downloads sharing it
+// open to each host, and keeps the connection limit of the hosts
+// which pushed back on them, so that every download from a host
+// honors the lowered limit. It's safe for concurrent use.
+type HostLimits struct {
+	mu    sync.Mutex
+	hosts map[string]*hostConns
+}
+
+// NewHostLimits creates a HostLimits with no limits.
+func NewHostLimits() *HostLimits {
+	return &HostLimits{hosts: make(map[string]*hostConns)}
+}
+
+// Limit returns the maximum number of connections to host, 0
+// if the host hasn't pushed back.
+func (h *HostLimits) Limit(host string) int {
+	return h.get(host).limit()
+}
+
+// get returns the connections of host.
+func (h *HostLimits) get(host string) *hostConns {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.hosts[host]
+	if c == nil {
+		c = &hostConns{freed: make(chan struct{})}
+		h.hosts[host] = c
+	}
+	return c
+}
+
+// getHost returns the host of the url, the url itself is used
+// if it can't be parsed.
+func getHost(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil || pu.Host == "" {
+		return u
+	}
+	return pu.Host
+}
+
+// hostConns counts the connections to a host in use against a
+// limit, 0 meaning no limit.
+type hostConns struct {
+	mu     sync.Mutex
+	n, max int
+	// freed is closed and replaced once a connection
+	// is released.
+	freed chan struct{}
+}
+
+// acquire takes a slot, waiting for one to be released while
+// every slot is in use. It fails with the error of ctx once
+// ctx is done, without taking a slot.
+func (c *hostConns) acquire(ctx context.Context) error {
+	for {
+		c.mu.Lock()
+		if c.max == 0 || c.n < c.max {
+			c.n++
+			c.mu.Unlock()
+			return nil
+		}
+		freed := c.freed
+		c.mu.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire takes a slot if one is free, it reports whether a
+// slot was taken.
+func (c *hostConns) tryAcquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max != 0 && c.n >= c.max {
+		return false
+	}
+	c.n++
+	return true
+}
+
+// take takes a slot regardless of the limit.
+func (c *hostConns) take() {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+}
+
+// release frees a slot and wakes up the callers of acquire.
+func (c *hostConns) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.n--
+	close(c.freed)
+	c.freed = make(chan struct{})
+}
+
+// lower lowers the limit to one connection less than the ones
+// in use, it returns the new limit or 0 if it wasn't lowered.
+func (c *hostConns) lower() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	max := c.n - 1
+	if max < 1 {
+		max = 1
+	}
+	if c.max != 0 && c.max <= max {
+		return 0
+	}
+	c.max = max
+	return max
+}
+
+func (c *hostConns) limit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
@@ -0,0 +1,134 @@
+package warplib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostConns_acquire(t *testing.T) {
+	c := NewHostLimits().get("example.com")
+	for i := 0; i < 3; i++ {
+		c.take()
+	}
+	if n := c.lower(); n != 2 {
+		t.Fatalf("lower() = %d with 3 connections, want 2", n)
+	}
+	if n := c.lower(); n != 0 {
+		t.Errorf("lower() = %d with the limit reached, want 0", n)
+	}
+	if c.tryAcquire() {
+		t.Fatal("tryAcquire() took a slot past the limit")
+	}
+	acquired := make(chan error)
+	go func() { acquired <- c.acquire(context.Background()) }()
+	c.release()
+	select {
+	case <-acquired:
+		t.Fatal("acquire() took a slot past the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire() didn't take the released slot")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { acquired <- c.acquire(ctx) }()
+	cancel()
+	if err := <-acquired; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() of done context error = %v, want %v", err, context.Canceled)
+	}
+	if c.n != 2 {
+		t.Errorf("%d slots in use, want 2", c.n)
+	}
+}
+
+// TestDownloader_pushback downloads from a server rejecting more
+// than two connections at once, the parts it rejects have to wait
+// for a free connection instead of retrying until they give up.
+func TestDownloader_pushback(t *testing.T) {
+	data := make([]byte, 2*MB)
+	rand.Read(data)
+	serve := rangeHandler(data, 5*time.Millisecond)
+	var armed atomic.Bool
+	var inflight, rejected atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests fetching the info of the file aren't limited.
+		if !armed.Load() {
+			serve(w, r)
+			return
+		}
+		defer inflight.Add(-1)
+		if inflight.Add(1) > 2 {
+			rejected.Add(1)
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serve(w, r)
+	}))
+	defer srv.Close()
+	hosts := NewHostLimits()
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		NumBaseParts:      4,
+		MaxConnections:    4,
+		MaxSegments:       4,
+		HostLimits:        hosts,
+		RetryPolicy: &RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 10 * time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	armed.Store(true)
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(d.GetSavePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+	if rejected.Load() == 0 {
+		t.Fatal("server didn't push back")
+	}
+	host := getHost(srv.URL)
+	if n := hosts.Limit(host); n < 1 || n > 3 {
+		t.Errorf("Limit(%q) = %d, want 1 to 3", host, n)
+	}
+	// the limit applies to the next download from the host.
+	d2, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		NumBaseParts:      4,
+		MaxConnections:    4,
+		HostLimits:        hosts,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d2.lw.Close()
+	d2.host = hosts.get(host)
+	d2.capBaseParts()
+	if d2.numBaseParts > hosts.Limit(host) {
+		t.Errorf("next download starts %d parts, want at most %d", d2.numBaseParts, hosts.Limit(host))
+	}
+}
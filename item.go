@@ -1,6 +1,7 @@
 package warplib
 
 import (
+	"context"
 	"path/filepath"
 	"sync"
 	"time"
@@ -19,25 +20,46 @@ type Item struct {
 	ChildHash        string
 	Hidden           bool
 	Children         bool
-	Parts            map[int64]*ItemPart
-	mu               *sync.RWMutex
-	dAlloc           *Downloader
-	memPart          map[string]int64
+	DirectWrite      bool
+	Checksums        []Checksum
+	// ETag and LastModified identify the version of
+	// the remote file being downloaded.
+	ETag         string
+	LastModified string
+	Parts        map[int64]*ItemPart
+	// State is the lifecycle state of the item, LastError
+	// is the error it last failed with.
+	State      ItemState
+	LastError  string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	mu         *sync.RWMutex
+	dAlloc     *Downloader
+	memPart    map[string]int64
+	// onState is called once the state of the item changes
+	onState func(hash string, s ItemState, err error)
 }
 
 type ItemPart struct {
 	Hash        string
 	FinalOffset int64
 	Compiled    bool
+	// Downloaded is the number of bytes downloaded for
+	// the part, it is used as the resume cursor of parts
+	// written directly to the download file.
+	Downloaded int64
 }
 
 type ItemsMap map[string]*Item
 
 type itemOpts struct {
 	Hide, Child      bool
+	DirectWrite      bool
+	Checksums        []Checksum
 	ChildHash        string
 	AbsoluteLocation string
 	Headers          []Header
+	Validator        validator
 }
 
 func newItem(mu *sync.RWMutex, name, url, dlloc, hash string, totalSize ContentLength, opts *itemOpts) (i *Item, err error) {
@@ -62,7 +84,12 @@ func newItem(mu *sync.RWMutex, name, url, dlloc, hash string, totalSize ContentL
 		ChildHash:        opts.ChildHash,
 		Hidden:           opts.Hide,
 		Children:         opts.Child,
+		DirectWrite:      opts.DirectWrite,
+		Checksums:        opts.Checksums,
+		ETag:             opts.Validator.etag,
+		LastModified:     opts.Validator.lastModified,
 		Parts:            make(map[int64]*ItemPart),
+		State:            ItemStatePending,
 		memPart:          make(map[string]int64),
 		mu:               mu,
 	}
@@ -72,13 +99,112 @@ func newItem(mu *sync.RWMutex, name, url, dlloc, hash string, totalSize ContentL
 func (i *Item) addPart(hash string, ioff, foff int64) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
-	i.Parts[ioff] = &ItemPart{
-		Hash:        hash,
-		FinalOffset: foff,
+	part := i.Parts[ioff]
+	if part == nil || part.Hash != hash {
+		part = &ItemPart{Hash: hash}
+		i.Parts[ioff] = part
 	}
+	// a respawned part keeps its progress.
+	part.FinalOffset = foff
 	i.memPart[hash] = ioff
 }
 
+func (i *Item) getValidator() validator {
+	return validator{i.ETag, i.LastModified}
+}
+
+// reset clears the progress of the item for the download to
+// be restarted with d.
+func (i *Item) reset(d *Downloader) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.TotalSize = d.contentLength
+	i.Downloaded = 0
+	i.Checksums = d.checksums
+	i.ETag = d.vd.etag
+	i.LastModified = d.vd.lastModified
+	i.Parts = make(map[int64]*ItemPart)
+	i.memPart = make(map[string]int64)
+}
+
+// migrateStaging restarts an incomplete item saved before the
+// downloads were staged in the data directory. The parts it has
+// compiled are in the file at its save path instead of the
+// staging file, so it can't be resumed.
+func (i *Item) migrateStaging() {
+	for _, part := range i.Parts {
+		if !part.Compiled {
+			continue
+		}
+		i.Parts = make(map[int64]*ItemPart)
+		i.Downloaded = 0
+		return
+	}
+}
+
+// mergePart extends the part at ioff till foff, absorbing the
+// part with hash mhash and its progress.
+func (i *Item) mergePart(mhash string, ioff, foff int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	part := i.Parts[ioff]
+	if part == nil {
+		return
+	}
+	moff, ok := i.memPart[mhash]
+	if mpart := i.Parts[moff]; ok && mpart != nil && mpart.Hash == mhash {
+		part.Downloaded += mpart.Downloaded
+		delete(i.Parts, moff)
+		delete(i.memPart, mhash)
+	}
+	part.FinalOffset = foff
+}
+
+// addProgress adds the bytes downloaded by the part with hash
+// to the progress of the item and the part.
+func (i *Item) addProgress(hash string, nread int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.Downloaded += ContentLength(nread)
+	part := i.Parts[i.memPart[hash]]
+	if part == nil || part.Hash != hash {
+		return
+	}
+	part.Downloaded += int64(nread)
+}
+
+// setDownloader makes d the download of the item.
+func (i *Item) setDownloader(d *Downloader) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dAlloc = d
+}
+
+// clone returns a copy of the item for the store, which encodes
+// it while the item keeps changing. The item has to be locked.
+func (i *Item) clone() *Item {
+	c := *i
+	c.Headers = append(Headers(nil), i.Headers...)
+	c.Checksums = append([]Checksum(nil), i.Checksums...)
+	c.Parts = make(map[int64]*ItemPart, len(i.Parts))
+	for ioff, part := range i.Parts {
+		cp := *part
+		c.Parts[ioff] = &cp
+	}
+	c.dAlloc = nil
+	c.memPart = nil
+	c.onState = nil
+	return &c
+}
+
+// getDownloader returns the download of the item, nil if it
+// has none.
+func (i *Item) getDownloader() *Downloader {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.dAlloc
+}
+
 func (i *Item) savePart(offset int64, part *ItemPart) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -94,6 +220,9 @@ func (i *Item) getPart(hash string) (offset int64, part *ItemPart) {
 }
 
 func (i *Item) GetPercentage() int64 {
+	if i.TotalSize.IsUnknown() {
+		return 0
+	}
 	p := (i.Downloaded * 100) / i.TotalSize
 	return p.v()
 }
@@ -109,5 +238,51 @@ func (i *Item) GetAbsolutePath() (aPath string) {
 }
 
 func (i *Item) Resume() error {
-	return i.dAlloc.Resume(i.Parts)
+	return i.ResumeContext(context.Background())
+}
+
+// ResumeContext is like Resume but the download is stopped
+// as soon as ctx is done.
+func (i *Item) ResumeContext(ctx context.Context) error {
+	// the download moves the item to running once it starts,
+	// the item keeps its state if it returns before.
+	i.mu.RLock()
+	err := i.checkTransition(ItemStateRunning)
+	i.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return i.dAlloc.ResumeContext(ctx, i.copyParts())
+}
+
+// copyParts returns a copy of the parts of the item, which are
+// changed by the events of the download while it's resumed.
+func (i *Item) copyParts() map[int64]*ItemPart {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	parts := make(map[int64]*ItemPart, len(i.Parts))
+	for ioff, part := range i.Parts {
+		cp := *part
+		parts[ioff] = &cp
+	}
+	return parts
+}
+
+// Stop stops the download resumed with Resume, it is a
+// no-op if the item isn't being downloaded.
+func (i *Item) Stop() {
+	if i.dAlloc == nil {
+		return
+	}
+	i.dAlloc.Stop()
+}
+
+// SetSpeedLimit caps the speed of the download resumed with
+// Resume to bps bytes per second, 0 removes the limit. It is
+// a no-op if the item isn't being downloaded.
+func (i *Item) SetSpeedLimit(bps int64) {
+	if i.dAlloc == nil {
+		return
+	}
+	i.dAlloc.SetSpeedLimit(bps)
 }
@@ -0,0 +1,249 @@
+package warplib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// _JSONL_COMPACT_MIN is the minimum number of records a JSON lines
+// store has to hold before it's compacted.
+const _JSONL_COMPACT_MIN = 1024
+
+// jsonlRecord is a line of a JSON lines store, the first line
+// only holds the version of the store.
+type jsonlRecord struct {
+	Version int    `json:"version,omitempty"`
+	Put     *Item  `json:"put,omitempty"`
+	Delete  string `json:"delete,omitempty"`
+}
+
+// JSONLStore is a Store appending every change as a line of JSON
+// to a log file, which is compacted once it's mostly made of
+// outdated records. Only the last change can be lost in a crash.
+// Loading the store locks the log until the store is closed so
+// that only one process writes to it.
+type JSONLStore struct {
+	path     string
+	readOnly bool
+	closed   bool
+	mu       sync.Mutex
+	lock     *os.File
+	f        *os.File
+	items    ItemsMap
+	// number of records in the log
+	records int
+}
+
+// NewJSONLStore creates a JSONLStore logging the changes to the
+// file at path.
+func NewJSONLStore(path string) *JSONLStore {
+	return &JSONLStore{path: path, items: make(ItemsMap)}
+}
+
+// NewReadOnlyJSONLStore creates a JSONLStore replaying the log
+// at path without locking it, it refuses changes with
+// ErrReadOnly.
+func NewReadOnlyJSONLStore(path string) *JSONLStore {
+	s := NewJSONLStore(path)
+	s.readOnly = true
+	return s
+}
+
+func (s *JSONLStore) Load() (items ItemsMap, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.readOnly && s.lock == nil {
+		s.lock, err = acquireLock(s.path)
+		if err != nil {
+			return
+		}
+	}
+	items, err = s.replay()
+	if err != nil {
+		releaseLock(s.lock)
+		s.lock = nil
+	}
+	return
+}
+
+// replay reads the items from the log, compacting it unless the
+// store is read-only.
+func (s *JSONLStore) replay() (items ItemsMap, err error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.items, err = decodeJSONL(data)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", s.path, err)
+		return
+	}
+	if !s.readOnly {
+		// compacting drops outdated records and a torn last line.
+		err = s.compact()
+		if err != nil {
+			return
+		}
+	}
+	items = make(ItemsMap, len(s.items))
+	for hash, item := range s.items {
+		items[hash] = item
+	}
+	return
+}
+
+// decodeJSONL replays the records of a JSON lines store. A last
+// line without a newline is the result of an interrupted write
+// and is ignored if it isn't valid.
+func decodeJSONL(data []byte) (items ItemsMap, err error) {
+	items = make(ItemsMap)
+	if len(data) == 0 {
+		return
+	}
+	lines := bytes.Split(data, []byte{'\n'})
+	version := 0
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var rec jsonlRecord
+		er := json.Unmarshal(line, &rec)
+		if er != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("%w: line %d: %v", ErrDatabaseCorrupt, i+1, er)
+		}
+		switch {
+		case i == 0:
+			if rec.Version == 0 {
+				return nil, fmt.Errorf("%w: missing version", ErrDatabaseCorrupt)
+			}
+			version = rec.Version
+		case rec.Put != nil:
+			items[rec.Put.Hash] = rec.Put
+		case rec.Delete != "":
+			delete(items, rec.Delete)
+		}
+	}
+	if version > _DB_VERSION {
+		return nil, fmt.Errorf("%w: version %d", ErrDatabaseVersion, version)
+	}
+	for ; version < _DB_VERSION; version++ {
+		dbMigrations[version](items)
+	}
+	return
+}
+
+func (s *JSONLStore) Put(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	// another process may hold the lock once it's released.
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.items[item.Hash] = item
+	return s.append(jsonlRecord{Put: item})
+}
+
+func (s *JSONLStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	// another process may hold the lock once it's released.
+	if s.closed {
+		return os.ErrClosed
+	}
+	if _, ok := s.items[hash]; !ok {
+		return nil
+	}
+	delete(s.items, hash)
+	return s.append(jsonlRecord{Delete: hash})
+}
+
+func (s *JSONLStore) List() ([]*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listItems(s.items), nil
+}
+
+func (s *JSONLStore) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	if er := releaseLock(s.lock); err == nil {
+		err = er
+	}
+	s.lock = nil
+	return
+}
+
+// ReadOnly reports whether the store was opened read-only.
+func (s *JSONLStore) ReadOnly() bool {
+	return s.readOnly
+}
+
+func (s *JSONLStore) append(rec jsonlRecord) (err error) {
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	_, err = s.f.Write(append(line, '\n'))
+	if err != nil {
+		return
+	}
+	err = s.f.Sync()
+	if err != nil {
+		return
+	}
+	s.records++
+	if s.records > _JSONL_COMPACT_MIN && s.records > 2*len(s.items) {
+		err = s.compact()
+	}
+	return
+}
+
+// compact replaces the log with a version record followed by a
+// record for every item.
+func (s *JSONLStore) compact() (err error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err = enc.Encode(jsonlRecord{Version: _DB_VERSION})
+	if err != nil {
+		return
+	}
+	for _, item := range s.items {
+		err = enc.Encode(jsonlRecord{Put: item})
+		if err != nil {
+			return
+		}
+	}
+	err = writeFileAtomic(s.path, buf.Bytes())
+	if err != nil {
+		return
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	s.records = len(s.items) + 1
+	return
+}
@@ -0,0 +1,52 @@
+package warplib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// errLockHeld is returned by tryLock when another process
+// holds the lock.
+var errLockHeld = errors.New("lock is held")
+
+// getLockPath returns the lock file guarding the database at
+// path, the database itself can't hold the lock as it's
+// replaced on every save.
+func getLockPath(path string) string {
+	return path + ".lock"
+}
+
+// acquireLock takes the advisory lock guarding the database at
+// path without waiting, it fails with ErrManagerLocked if
+// another process holds it. The lock lasts until the returned
+// file is closed.
+func acquireLock(path string) (f *os.File, err error) {
+	lpath := getLockPath(path)
+	err = os.MkdirAll(filepath.Dir(lpath), os.ModePerm)
+	if err != nil {
+		return
+	}
+	f, err = os.OpenFile(lpath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	err = tryLock(f)
+	if err != nil {
+		f.Close()
+		f = nil
+	}
+	if errors.Is(err, errLockHeld) {
+		err = ErrManagerLocked
+	}
+	return
+}
+
+// releaseLock releases the lock taken by acquireLock, f may
+// be nil.
+func releaseLock(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package warplib
+
+import "os"
+
+// tryLock is a no-op on systems without flock, the database
+// isn't guarded against other processes there.
+func tryLock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,127 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows
+
+package warplib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	stores := []struct {
+		name     string
+		open     func() Store
+		readOnly func() Store
+	}{
+		{
+			"file",
+			func() Store { return NewFileStore(filepath.Join(dir, "userdata.warp")) },
+			func() Store { return NewReadOnlyFileStore(filepath.Join(dir, "userdata.warp")) },
+		},
+		{
+			"jsonl",
+			func() Store { return NewJSONLStore(filepath.Join(dir, "userdata.jsonl")) },
+			func() Store { return NewReadOnlyJSONLStore(filepath.Join(dir, "userdata.jsonl")) },
+		},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			owner := st.open()
+			if _, err := owner.Load(); err != nil {
+				t.Fatal(err)
+			}
+			if err := owner.Put(&Item{Hash: "a", TotalSize: 10}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.open().Load(); !errors.Is(err, ErrManagerLocked) {
+				t.Fatalf("Load() of locked store error = %v, want %v", err, ErrManagerLocked)
+			}
+			_, err := NewManager(&Config{ConfigDir: t.TempDir()}, st.open())
+			if !errors.Is(err, ErrManagerLocked) {
+				t.Fatalf("NewManager() with locked store error = %v, want %v", err, ErrManagerLocked)
+			}
+
+			ro := st.readOnly()
+			items, err := ro.Load()
+			if err != nil || items["a"] == nil {
+				t.Fatalf("Load() of read-only store = %v, %v, want item a", items, err)
+			}
+			if err = ro.Put(&Item{Hash: "b"}); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("Put() on read-only store error = %v, want %v", err, ErrReadOnly)
+			}
+			if err = ro.Delete("a"); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("Delete() on read-only store error = %v, want %v", err, ErrReadOnly)
+			}
+			ro.Close()
+
+			if err = owner.Close(); err != nil {
+				t.Fatal(err)
+			}
+			next := st.open()
+			if _, err = next.Load(); err != nil {
+				t.Fatalf("Load() after the owner closed error = %v", err)
+			}
+			// the closed owner mustn't write over the store of
+			// the next one.
+			if err = owner.Put(&Item{Hash: "b"}); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Put() on closed store error = %v, want %v", err, os.ErrClosed)
+			}
+			if err = owner.Delete("a"); !errors.Is(err, os.ErrClosed) {
+				t.Errorf("Delete() on closed store error = %v, want %v", err, os.ErrClosed)
+			}
+			next.Close()
+			items, err = st.readOnly().Load()
+			if err != nil || len(items) != 1 || items["a"] == nil {
+				t.Errorf("Load() after writes to the closed store = %v, %v, want item a", items, err)
+			}
+		})
+	}
+}
+
+func TestInitManagerReadOnly(t *testing.T) {
+	cfg := &Config{ConfigDir: t.TempDir()}
+	owner, err := InitManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	owner.UpdateItem(&Item{Hash: "a", TotalSize: 10, State: ItemStatePending})
+	if _, err = InitManager(cfg); !errors.Is(err, ErrManagerLocked) {
+		t.Fatalf("InitManager() error = %v, want %v", err, ErrManagerLocked)
+	}
+	m, err := InitManagerReadOnly(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.GetItem("a") == nil {
+		t.Errorf("GetItem() = nil, want item a")
+	}
+	if err = m.AddDownload(&Downloader{}, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("AddDownload() error = %v, want %v", err, ErrReadOnly)
+	}
+	if _, err = m.ResumeDownload(nil, "a", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("ResumeDownload() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.FlushOne("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("FlushOne() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.SetMaxConcurrentDownloads(1); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetMaxConcurrentDownloads() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.SetPriority("a", 1); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetPriority() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.MoveInQueue("a", 0); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("MoveInQueue() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.Dequeue("a"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Dequeue() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err = m.SetSchedule(nil, nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetSchedule() error = %v, want %v", err, ErrReadOnly)
+	}
+}
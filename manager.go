@@ -1,41 +1,128 @@
 package warplib
 
 import (
-	"encoding/gob"
 	"errors"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
-var __USERDATA_FILE_NAME = ConfigDir + "/userdata.warp"
-
 type Manager struct {
 	items ItemsMap
-	f     *os.File
-	mu    *sync.RWMutex
-	wg    *sync.WaitGroup
+	// store persists the items
+	store Store
+	// readOnly is set if the store refuses changes
+	readOnly bool
+	// directories used by the downloads
+	cfg *Config
+	mu  *sync.RWMutex
+	wg  *sync.WaitGroup
 	// flush-mutex
 	fmu *sync.RWMutex
+	// limiter caps the combined speed of all downloads
+	limiter *RateLimiter
+	// hosts shares the connection limits of the hosts
+	// between the downloads
+	hosts *HostLimits
+	// smu guards the schedule state
+	smu sync.Mutex
+	// sstop stops the running schedule, which closes
+	// sdone once it returns.
+	sstop, sdone chan struct{}
+	// paused is set while the schedule pauses downloads
+	paused bool
+	// hashes of the downloads paused by the schedule
+	spaused []string
+	// qmu guards the queue state
+	qmu sync.Mutex
+	// items waiting to be downloaded, in order
+	queue []*queueEntry
+	// items being downloaded by the queue
+	running map[string]*queueEntry
+	// maximum number of items downloaded by the
+	// queue at the same time, 0 means no limit
+	maxDownloads int
+	// wmu orders the writes to the store
+	wmu sync.Mutex
+	// dmu guards the pending saves
+	dmu sync.Mutex
+	// items with progress not saved yet
+	dirty map[string]*Item
+	// flushTimer saves the dirty items once it fires
+	flushTimer    *time.Timer
+	flushInterval time.Duration
+	// evmu guards the event state
+	evmu sync.Mutex
+	// evch is the channel returned by Events, ev feeds
+	// it once it's created.
+	evch chan Event
+	ev   *dispatcher
+	// evstop is closed once the manager is closed
+	evstop   chan struct{}
+	evclosed bool
+}
+
+// InitManager creates a manager saving its items to the
+// userdata.warp file in the config directory of cfg, the
+// default directories are used if cfg is nil.
+func InitManager(cfg *Config) (m *Manager, err error) {
+	cfg, err = resolveConfig(cfg)
+	if err != nil {
+		return
+	}
+	return NewManager(cfg, NewFileStore(cfg.userdataPath()))
+}
+
+// InitManagerReadOnly creates a manager reading its items from
+// the database used by InitManager without locking it, so that
+// the items can be inspected while another process owns the
+// database. Downloads can't be added, resumed or flushed with
+// it, they fail with ErrReadOnly.
+func InitManagerReadOnly(cfg *Config) (m *Manager, err error) {
+	cfg, err = resolveConfig(cfg)
+	if err != nil {
+		return
+	}
+	return NewManager(cfg, NewReadOnlyFileStore(cfg.userdataPath()))
 }
 
-func InitManager() (m *Manager, err error) {
+// NewManager creates a manager saving its items to store, the
+// default directories are used if cfg is nil. It fails with
+// ErrManagerLocked if another process owns the database of a
+// file based store.
+func NewManager(cfg *Config, store Store) (m *Manager, err error) {
+	cfg, err = resolveConfig(cfg)
+	if err != nil {
+		return
+	}
 	m = &Manager{
-		items: make(ItemsMap),
-		mu:    new(sync.RWMutex),
-		wg:    new(sync.WaitGroup),
-		fmu:   new(sync.RWMutex),
-	}
-	m.f, err = os.OpenFile(
-		__USERDATA_FILE_NAME,
-		os.O_RDWR|os.O_CREATE,
-		os.ModePerm,
-	)
+		cfg:           cfg,
+		items:         make(ItemsMap),
+		mu:            new(sync.RWMutex),
+		wg:            new(sync.WaitGroup),
+		fmu:           new(sync.RWMutex),
+		limiter:       NewRateLimiter(0),
+		hosts:         NewHostLimits(),
+		running:       make(map[string]*queueEntry),
+		maxDownloads:  DEF_MAX_CONCURRENT_DOWNLOADS,
+		store:         store,
+		readOnly:      isReadOnly(store),
+		dirty:         make(map[string]*Item),
+		flushInterval: DEF_FLUSH_INTERVAL,
+		evstop:        make(chan struct{}),
+	}
+	// a corrupt database is reported rather than replaced
+	// with an empty one.
+	items, err := store.Load()
 	if err != nil {
 		m = nil
 		return
 	}
-	_ = gob.NewDecoder(m.f).Decode(&m.items)
+	// the store keeps its own copies of the items.
+	for hash, item := range items {
+		m.items[hash] = item.clone()
+	}
 	m.populateMemPart()
 	return
 }
@@ -49,6 +136,8 @@ type AddDownloadOpts struct {
 
 func (m *Manager) populateMemPart() {
 	for _, item := range m.items {
+		item.mu = m.mu
+		item.onState = m.stateChanged
 		if item.memPart == nil {
 			item.memPart = make(map[string]int64)
 		}
@@ -58,7 +147,21 @@ func (m *Manager) populateMemPart() {
 	}
 }
 
+// AddDownload adds the download d to the manager. It fails with
+// ErrConfigMismatch if d doesn't use the config of the manager,
+// since the manager keeps the data of its downloads in its own
+// directories, and with ErrDownloadNotSetUp if d was created
+// with SkipSetup.
 func (m *Manager) AddDownload(d *Downloader, opts *AddDownloadOpts) (err error) {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if d.cfg == nil {
+		return ErrDownloadNotSetUp
+	}
+	if *d.cfg != *m.cfg {
+		return ErrConfigMismatch
+	}
 	m.fmu.RLock()
 	defer m.fmu.RUnlock()
 	if opts == nil {
@@ -81,83 +184,134 @@ func (m *Manager) AddDownload(d *Downloader, opts *AddDownloadOpts) (err error)
 			Hide:             opts.IsHidden,
 			ChildHash:        cHash,
 			Headers:          d.headers,
+			DirectWrite:      d.direct,
+			Checksums:        d.checksums,
+			Validator:        d.vd,
 		},
 	)
 	if err != nil {
 		return err
 	}
-	// item.dAlloc = d
+	if d.shared == nil {
+		d.shared = m.limiter
+	}
+	if d.hosts == nil {
+		d.hosts = m.hosts
+	}
 	m.UpdateItem(item)
-	m.wg.Add(1)
-	m.patchHandlers(d, item)
+	m.track(d, item)
+	item.setDownloader(d)
 	return
 }
 
-func (m *Manager) patchHandlers(d *Downloader, item *Item) {
-	oSPH := d.handlers.SpawnPartHandler
-	d.handlers.SpawnPartHandler = func(hash string, ioff, foff int64) {
-		item.addPart(hash, ioff, foff)
-		m.UpdateItem(item)
-		oSPH(hash, ioff, foff)
-	}
-	oRPH := d.handlers.RespawnPartHandler
-	d.handlers.RespawnPartHandler = func(hash string, partIoff, ioffNew, foffNew int64) {
-		item.addPart(hash, partIoff, foffNew)
-		m.UpdateItem(item)
-		oRPH(hash, partIoff, ioffNew, foffNew)
-	}
-	oPH := d.handlers.DownloadProgressHandler
-	d.handlers.DownloadProgressHandler = func(hash string, nread int) {
-		item.Downloaded += ContentLength(nread)
-		m.UpdateItem(item)
-		oPH(hash, nread)
-	}
-	oCCH := d.handlers.CompileCompleteHandler
-	d.handlers.CompileCompleteHandler = func(hash string, tread int64) {
-		off, part := item.getPart(hash)
-		if part == nil {
-			d.handlers.ErrorHandler(hash, errors.New("manager part item is nil"))
+// track keeps the item in sync with the events of its download.
+func (m *Manager) track(d *Downloader, item *Item) {
+	// the download is counted while it runs, so that the
+	// manager waits for it before flushing.
+	d.mwg = m.wg
+	d.listen(func(ev Event) {
+		switch ev := ev.(type) {
+		case PartSpawnedEvent:
+			item.addPart(ev.Part, ev.Ioff, ev.Foff)
+			m.UpdateItem(item)
+		case PartRespawnedEvent:
+			item.addPart(ev.Part, ev.Ioff, ev.FoffNew)
+			m.UpdateItem(item)
+		case PartMergedEvent:
+			item.mergePart(ev.Merged, ev.Ioff, ev.Foff)
+			m.UpdateItem(item)
+		case ProgressEvent:
+			item.addProgress(ev.Part, ev.Bytes)
+			// progress is saved in batches.
+			m.markDirty(item)
+		case CompileCompletedEvent:
+			off, part := item.getPart(ev.Part)
+			if part == nil {
+				d.emit(ErrorEvent{EventBase{d.hash}, ev.Part, errors.New("manager part item is nil")})
+				return
+			}
+			part.Compiled = true
+			item.savePart(off, part)
+			m.UpdateItem(item)
+		case CompletedEvent:
+			if ev.Part != MAIN_HASH {
+				break
+			}
+			// the event comes before the state change.
+			m.emit(ev)
+			item.Parts = nil
+			// total size of a streamed download is only
+			// known once it's complete.
+			item.TotalSize = ContentLength(ev.Size)
+			item.Downloaded = item.TotalSize
+			m.setItemState(item, ItemStateCompleted, nil)
+			m.UpdateItem(item)
+			// start the next queued item.
+			m.finishQueued(item.Hash)
 			return
-		}
-		part.Compiled = true
-		item.savePart(off, part)
-		oCCH(hash, tread)
-	}
-	oDCH := d.handlers.DownloadCompleteHandler
-	d.handlers.DownloadCompleteHandler = func(hash string, tread int64) {
-		if hash != MAIN_HASH {
+		case StateChangedEvent:
+			// state changes are sent by the item itself.
+			if ev.State != ItemStateCompleted {
+				m.setItemState(item, ev.State, ev.Err)
+				m.UpdateItem(item)
+			}
 			return
 		}
-		defer m.wg.Done()
-		item.Parts = nil
-		item.Downloaded = item.TotalSize
-		m.UpdateItem(item)
-		oDCH(hash, tread)
+		m.emit(ev)
+	})
+}
+
+// setItemState moves the item to the state s, invalid transitions
+// are ignored as a download reports every event of it regardless
+// of the state the item is in.
+func (m *Manager) setItemState(item *Item, s ItemState, err error) {
+	_ = item.setState(s, err)
+}
+
+// put saves a copy of the item to the store, the downloads
+// aren't held up while the store writes it.
+func (m *Manager) put(item *Item) (err error) {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	m.mu.RLock()
+	// the item may have been removed since it was changed.
+	if m.items[item.Hash] != item {
+		m.mu.RUnlock()
+		return
 	}
+	c := item.clone()
+	m.mu.RUnlock()
+	return m.store.Put(c)
 }
 
-func (m *Manager) encode(e any) (err error) {
-	m.mu.Lock()
-	m.f.Seek(0, 0)
-	defer m.mu.Unlock()
-	return gob.NewEncoder(m.f).Encode(e)
+// delete removes the item with hash from the store.
+func (m *Manager) delete(hash string) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	return m.store.Delete(hash)
 }
 
 func (m *Manager) mapItem(item *Item) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if item.onState == nil {
+		item.onState = m.stateChanged
+	}
 	m.items[item.Hash] = item
 }
 
 func (m *Manager) deleteItem(hash string) {
+	m.clean(hash)
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.items, hash)
 }
 
+// UpdateItem saves the item to the store right away.
 func (m *Manager) UpdateItem(item *Item) {
 	m.mapItem(item)
-	m.encode(m.items)
+	m.clean(item.Hash)
+	m.put(item)
 }
 
 func (m *Manager) GetItems() []*Item {
@@ -186,7 +340,7 @@ func (m *Manager) GetPublicItems() []*Item {
 func (m *Manager) GetIncompleteItems() []*Item {
 	var items = []*Item{}
 	for _, item := range m.GetItems() {
-		if item.TotalSize == item.Downloaded {
+		if item.GetState() == ItemStateCompleted {
 			continue
 		}
 		items = append(items, item)
@@ -195,12 +349,20 @@ func (m *Manager) GetIncompleteItems() []*Item {
 }
 
 func (m *Manager) GetCompletedItems() []*Item {
+	return m.GetItemsByState(ItemStateCompleted)
+}
+
+// GetItemsByState returns the items in any of the states.
+func (m *Manager) GetItemsByState(states ...ItemState) []*Item {
 	var items = []*Item{}
 	for _, item := range m.GetItems() {
-		if item.TotalSize != item.Downloaded {
-			continue
+		state := item.GetState()
+		for _, s := range states {
+			if s == state {
+				items = append(items, item)
+				break
+			}
 		}
-		items = append(items, item)
 	}
 	return items
 }
@@ -227,9 +389,23 @@ type ResumeDownloadOpts struct {
 	MaxSegments int
 	Headers     Headers
 	Handlers    *Handlers
+	// RetryPolicy configures retrying of failed parts,
+	// the default policy is used if it's nil.
+	RetryPolicy *RetryPolicy
+	// RestartIfChanged makes the download restart from
+	// scratch if the remote file has changed since the
+	// download began, ErrRemoteChanged is returned otherwise.
+	RestartIfChanged bool
+	// SpeedLimit caps the download speed in bytes per
+	// second, 0 means no limit.
+	SpeedLimit int64
 }
 
 func (m *Manager) ResumeDownload(client *http.Client, hash string, opts *ResumeDownloadOpts) (item *Item, err error) {
+	if m.readOnly {
+		err = ErrReadOnly
+		return
+	}
 	m.fmu.RLock()
 	defer m.fmu.RUnlock()
 	if opts == nil {
@@ -261,42 +437,142 @@ func (m *Manager) ResumeDownload(client *http.Client, hash string, opts *ResumeD
 		FileName:          item.Name,
 		DownloadDirectory: item.DownloadLocation,
 		Headers:           item.Headers,
+		DirectWrite:       item.DirectWrite,
+		Checksums:         item.Checksums,
+		RetryPolicy:       opts.RetryPolicy,
+		SpeedLimit:        opts.SpeedLimit,
+		SharedLimiter:     m.limiter,
+		HostLimits:        m.hosts,
+		Config:            m.cfg,
 	})
 	if er != nil {
 		err = er
 		return
 	}
-	m.wg.Add(1)
-	m.patchHandlers(d, item)
-	item.dAlloc = d
-	// m.UpdateItem(item)
+	d.vd = item.getValidator()
+	err = d.checkRemote()
+	if errors.Is(err, ErrRemoteChanged) && opts.RestartIfChanged {
+		err = d.reset(item.Parts)
+		if err == nil {
+			item.reset(d)
+			m.UpdateItem(item)
+		}
+	}
+	if err == nil && len(item.Parts) == 0 && item.Downloaded != item.TotalSize {
+		// the download was added but never started.
+		err = d.prepareStart()
+	}
+	if err != nil {
+		d.lw.Close()
+		return
+	}
+	if old := item.getDownloader(); old != nil {
+		// the download added with AddDownload is replaced.
+		old.retire()
+	}
+	m.track(d, item)
+	item.setDownloader(d)
 	return
 }
 
+// SetSpeedLimit caps the combined speed of all the downloads
+// of the manager to bps bytes per second, 0 removes the limit.
+// It takes effect immediately on running downloads.
+func (m *Manager) SetSpeedLimit(bps int64) {
+	m.limiter.SetRate(bps)
+}
+
+// GetSpeedLimit returns the combined speed limit of the
+// downloads in bytes per second, 0 if there's no limit.
+func (m *Manager) GetSpeedLimit() int64 {
+	return m.limiter.Rate()
+}
+
 func (m *Manager) Flush() error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
 	m.wg.Wait()
 	m.fmu.Lock()
 	defer m.fmu.Unlock()
+	m.qmu.Lock()
+	m.mu.Lock()
+	items := m.items
 	m.items = make(ItemsMap)
-	m.encode(m.items)
-	return os.RemoveAll(DlDataDir)
+	// queued items are removed along with the rest.
+	m.queue = nil
+	m.mu.Unlock()
+	m.qmu.Unlock()
+	for hash := range items {
+		m.clean(hash)
+		m.delete(hash)
+	}
+	return os.RemoveAll(m.cfg.DataDir)
 }
 
-// TODO: make FlushOne safe for flushing while the item is being downloaded
-func (m *Manager) FlushOne(hash string) error {
+type RemoveDownloadOpts struct {
+	// DeleteFile removes the downloaded file at the save
+	// path as well, it only exists once the download is
+	// complete.
+	DeleteFile bool
+}
+
+// RemoveDownload removes the item with hash along with its
+// download data, which holds the partially downloaded file. A
+// download in progress is stopped and waited for first, so
+// that none of its parts writes to the removed data.
+func (m *Manager) RemoveDownload(hash string, opts *RemoveDownloadOpts) (err error) {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if opts == nil {
+		opts = &RemoveDownloadOpts{}
+	}
 	m.fmu.RLock()
 	defer m.fmu.RUnlock()
-	m.mu.RLock()
-	_, found := m.items[hash]
-	m.mu.RUnlock()
-	if !found {
-		return ErrFlushHashNotFound
+	item := m.lookupItem(hash)
+	if item == nil {
+		return ErrDownloadNotFound
+	}
+	// the queue mustn't start the item again once it's stopped.
+	freed := m.unqueue(hash)
+	if d := item.getDownloader(); d != nil {
+		d.stopAndWait()
 	}
 	m.deleteItem(hash)
-	m.encode(m.items)
-	return os.RemoveAll(GetPath(DlDataDir, hash))
+	err = m.delete(hash)
+	if er := os.RemoveAll(GetPath(m.cfg.DataDir, hash)); err == nil {
+		err = er
+	}
+	if opts.DeleteFile {
+		er := os.Remove(item.GetSavePath())
+		if err == nil && er != nil && !os.IsNotExist(er) {
+			err = er
+		}
+	}
+	if freed {
+		m.startQueued()
+	}
+	return
+}
+
+// FlushOne removes the item with hash along with its download
+// data, stopping it first if it's being downloaded. See
+// RemoveDownload.
+func (m *Manager) FlushOne(hash string) error {
+	err := m.RemoveDownload(hash, nil)
+	if errors.Is(err, ErrDownloadNotFound) {
+		err = ErrFlushHashNotFound
+	}
+	return err
 }
 
 func (m *Manager) Close() error {
-	return m.f.Close()
+	m.stopSchedule()
+	m.closeEvents()
+	err := m.flushDirty()
+	if er := m.store.Close(); err == nil {
+		err = er
+	}
+	return err
 }
@@ -21,6 +21,12 @@ const (
 
 const (
 	_SECOND = int64(time.Second)
+	// parts are only merged into the part before them
+	// if they have at least these many bytes pending.
+	_MIN_MERGE_SIZE = 4 * MB
+	// delays asked through the Retry-After header are
+	// parsed up to this limit.
+	_MAX_RETRY_AFTER = 24 * time.Hour
 )
 
 const (
@@ -29,6 +35,24 @@ const (
 	DEF_USER_AGENT = "Warp/1.0"
 )
 
+const (
+	DEF_MAX_ATTEMPTS    = 5
+	DEF_INITIAL_BACKOFF = 500 * time.Millisecond
+	DEF_MAX_BACKOFF     = 30 * time.Second
+	DEF_MAX_RETRY_AFTER = 5 * time.Minute
+
+	DEF_SCHEDULE_INTERVAL = time.Minute
+
+	DEF_MAX_CONCURRENT_DOWNLOADS = 3
+
+	DEF_FLUSH_INTERVAL = 2 * time.Second
+
+	DEF_EVENT_QUEUE_SIZE = 1024
+
+	DEF_SPEED_INTERVAL = 500 * time.Millisecond
+	DEF_SPEED_WINDOW   = 10 * time.Second
+)
+
 const MAIN_HASH = "main"
 
 func GetPath(directory, file string) (path string) {
@@ -119,39 +143,17 @@ func Place[t any](src []t, e t, index int) (dst []t) {
 // 	return
 // }
 
-var ConfigDir = func() (warpDir string) {
-	cdr, err := os.UserConfigDir()
-	if err != nil {
-		panic(err)
-	}
-	// weird stuff
-	if !dirExists(cdr) {
-		err = os.Mkdir(cdr, os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
-	}
-	warpDir = cdr + "/warp"
-	if dirExists(warpDir) {
-		return
-	}
-	err = os.Mkdir(warpDir, os.ModePerm)
-	if err != nil {
-		panic(err)
-	}
-	return
-}()
-
-var DlDataDir = func() (dlDir string) {
-	dlDir = ConfigDir + "/dldata"
-	if dirExists(dlDir) {
-		return
-	}
-	err := os.Mkdir(dlDir, os.ModePerm)
+// ConfigDir and DlDataDir are the default directories of the
+// config and the download data, they are empty if the user
+// config directory can't be determined.
+//
+// Deprecated: use Config to set the directories.
+var ConfigDir, DlDataDir = func() (string, string) {
+	cfg, err := DefaultConfig()
 	if err != nil {
-		panic(err)
+		return "", ""
 	}
-	return
+	return cfg.ConfigDir, cfg.DataDir
 }()
 
 // var CacheDir = func() (warpDir string) {
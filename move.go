@@ -0,0 +1,89 @@
+package warplib
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// moveFile moves the file at src to dst. Files can't be renamed
+// across filesystems, in which case src is copied to dst, which
+// is flushed to the disk and verified before src is removed.
+func moveFile(src, dst string, progress func(n int)) (err error) {
+	err = os.Rename(src, dst)
+	if err == nil || !errors.Is(err, errCrossDevice) {
+		return
+	}
+	err = copyFile(src, dst, progress)
+	if err != nil {
+		return
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to dst with progress reported after
+// every copied chunk, dst is removed if the copy fails.
+func copyFile(src, dst string, progress func(n int)) (err error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+	si, err := sf.Stat()
+	if err != nil {
+		return
+	}
+	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	written, err := copyChunks(df, sf, progress)
+	if err == nil {
+		err = df.Sync()
+	}
+	if er := df.Close(); err == nil {
+		err = er
+	}
+	if err != nil {
+		return
+	}
+	di, err := os.Stat(dst)
+	if err != nil {
+		return
+	}
+	if written != si.Size() || di.Size() != si.Size() {
+		err = ErrFinalizeSizeMismatch
+	}
+	return
+}
+
+func copyChunks(dst io.Writer, src io.Reader, progress func(n int)) (written int64, err error) {
+	buf := make([]byte, DEF_CHUNK_SIZE)
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			written += int64(nw)
+			progress(nw)
+			if ew != nil {
+				err = ew
+				return
+			}
+			if nr != nw {
+				err = io.ErrShortWrite
+				return
+			}
+		}
+		if er != nil {
+			if er != io.EOF {
+				err = er
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package warplib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_copyFile(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{"empty file", 0},
+		{"smaller than chunk", DEF_CHUNK_SIZE / 2},
+		{"multiple chunks", 3*DEF_CHUNK_SIZE + 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			data := bytes.Repeat([]byte{'w'}, int(tt.size))
+			if err := os.WriteFile(src, data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			var progress int64
+			err := copyFile(src, dst, func(n int) { progress += int64(n) })
+			if err != nil {
+				t.Fatalf("copyFile() error = %v", err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("copyFile() copied %d bytes, want %d", len(got), tt.size)
+			}
+			if progress != tt.size {
+				t.Errorf("copyFile() reported %d bytes, want %d", progress, tt.size)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package warplib
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -29,21 +30,54 @@ type Part struct {
 	ofunc DownloadCompleteHandlerFunc
 	// compile progress handler
 	cfunc CompileProgressHandlerFunc
+	// handler the downloaded bytes are passed to along
+	// with their offset in the main download file
+	wfunc func(off int64, b []byte)
 	// http client
 	client *http.Client
 	// prename
 	preName string
 	// part file
 	pf *os.File
+	// writer the downloaded bytes are copied to, it is
+	// the part file unless the part is a stream part.
+	w io.Writer
 	// offset of part
 	offset int64
+	// final offset of part
+	foff int64
 	// expected speed
 	etime time.Duration
 	// logger
-	l  *log.Logger
-	wg *sync.WaitGroup
+	l *log.Logger
 	// main download file
 	f *os.File
+	// ctx is cancelled to stop the part
+	ctx    context.Context
+	cancel context.CancelFunc
+	// mu guards done and absorbed, and read and foff
+	// which are read by the parts next to this one. The
+	// part reads them unguarded as it's their only writer.
+	mu sync.Mutex
+	// done is set once the part stops downloading
+	done bool
+	// absorbed is set once the part is merged into
+	// the part before it
+	absorbed bool
+	// stopped is closed once an absorbed part stops
+	stopped chan struct{}
+	// number of consecutive failed download attempts
+	attempts int
+	// bytes read when the part last failed
+	fread int64
+	// version of the remote file being downloaded
+	vd validator
+	// noRange is set if the server ignores ranges
+	noRange bool
+	// limiters the download speed is capped by
+	limiters []*RateLimiter
+	// time spent waiting for the limiters
+	throttled time.Duration
 }
 
 type partArgs struct {
@@ -56,22 +90,46 @@ type partArgs struct {
 	logger    *log.Logger
 	offset    int64
 	f         *os.File
+	// direct makes the part write to f at its offset
+	// instead of a part file.
+	direct bool
+	// number of bytes already written to f by a direct
+	// part that is being resumed.
+	read int64
+	// version of the remote file being downloaded
+	vd validator
+	// limiters the download speed is capped by
+	limiters []*RateLimiter
+	// noRange is set if the server ignores ranges
+	noRange bool
+	// handler the downloaded bytes are passed to
+	wHandler func(off int64, b []byte)
 }
 
-func initPart(wg *sync.WaitGroup, client *http.Client, hash, url string, args partArgs) (*Part, error) {
+func initPart(client *http.Client, hash, url string, args partArgs) (*Part, error) {
 	p := Part{
-		url:     url,
-		client:  client,
-		chunk:   args.copyChunk,
-		preName: args.preName,
-		pfunc:   args.pHandler,
-		ofunc:   args.oHandler,
-		cfunc:   args.cpHandler,
-		l:       args.logger,
-		offset:  args.offset,
-		hash:    hash,
-		wg:      wg,
-		f:       args.f,
+		url:      url,
+		client:   client,
+		chunk:    args.copyChunk,
+		preName:  args.preName,
+		pfunc:    args.pHandler,
+		ofunc:    args.oHandler,
+		cfunc:    args.cpHandler,
+		wfunc:    args.wHandler,
+		l:        args.logger,
+		offset:   args.offset,
+		hash:     hash,
+		f:        args.f,
+		vd:       args.vd,
+		noRange:  args.noRange,
+		limiters: args.limiters,
+		stopped:  make(chan struct{}),
+	}
+	if args.direct {
+		p.read = args.read
+		p.w = &offsetWriter{p.f, p.offset + p.read}
+		args.rpHandler(p.hash, int(p.read))
+		return &p, nil
 	}
 	err := p.openPartFile()
 	if err != nil {
@@ -84,30 +142,68 @@ func initPart(wg *sync.WaitGroup, client *http.Client, hash, url string, args pa
 	return &p, nil
 }
 
-func newPart(wg *sync.WaitGroup, client *http.Client, url string, args partArgs) (*Part, error) {
+func newPart(client *http.Client, url string, args partArgs) (*Part, error) {
 	p := Part{
-		url:     url,
-		client:  client,
-		chunk:   args.copyChunk,
-		preName: args.preName,
-		pfunc:   args.pHandler,
-		ofunc:   args.oHandler,
-		cfunc:   args.cpHandler,
-		l:       args.logger,
-		offset:  args.offset,
-		wg:      wg,
-		f:       args.f,
+		url:      url,
+		client:   client,
+		chunk:    args.copyChunk,
+		preName:  args.preName,
+		pfunc:    args.pHandler,
+		ofunc:    args.oHandler,
+		cfunc:    args.cpHandler,
+		wfunc:    args.wHandler,
+		l:        args.logger,
+		offset:   args.offset,
+		f:        args.f,
+		vd:       args.vd,
+		noRange:  args.noRange,
+		limiters: args.limiters,
+		stopped:  make(chan struct{}),
 	}
 	p.setHash()
+	if args.direct {
+		p.w = &offsetWriter{p.f, p.offset}
+		return &p, nil
+	}
 	return &p, p.createPartFile()
 }
 
+// newStreamPart creates a part which writes the downloaded
+// bytes straight to the main download file, it is used for
+// downloads of unknown size. A stream part starting at a
+// non-zero offset resumes a previous stream.
+func newStreamPart(client *http.Client, hash, url string, args partArgs) *Part {
+	p := Part{
+		url:      url,
+		client:   client,
+		chunk:    args.copyChunk,
+		pfunc:    args.pHandler,
+		ofunc:    args.oHandler,
+		cfunc:    args.cpHandler,
+		wfunc:    args.wHandler,
+		l:        args.logger,
+		read:     args.offset,
+		foff:     -1,
+		hash:     hash,
+		f:        args.f,
+		w:        &offsetWriter{args.f, args.offset},
+		vd:       args.vd,
+		noRange:  args.noRange,
+		limiters: args.limiters,
+		stopped:  make(chan struct{}),
+	}
+	if hash == "" {
+		p.setHash()
+	}
+	return &p
+}
+
 func (p *Part) setEpeed(espeed int64) {
 	p.etime = getDownloadTime(espeed, int64(p.chunk))
 }
 
-func (p *Part) download(headers Headers, ioff, foff int64, force bool) (slow bool, err error) {
-	req, er := http.NewRequest(http.MethodGet, p.url, nil)
+func (p *Part) download(ctx context.Context, headers Headers, ioff, foff int64, force bool) (slow bool, err error) {
+	req, er := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
 	if er != nil {
 		err = er
 		return
@@ -117,15 +213,93 @@ func (p *Part) download(headers Headers, ioff, foff int64, force bool) (slow boo
 	if foff != -1 {
 		setRange(header, ioff, foff)
 	} else {
+		// content of unknown size can only be requested
+		// from an offset till the end.
+		if ioff != 0 {
+			setRange(header, ioff, 0)
+		}
 		force = true
 	}
+	// make the server send the whole file instead of the
+	// range if the file has changed. A response to a range
+	// starting at 0 can't be told apart from the whole file,
+	// it's checked against the validators instead.
+	ifRange := ioff != 0 && !p.noRange && p.vd.ifRange() != ""
+	if ifRange {
+		header.Set("If-Range", p.vd.ifRange())
+	}
 	resp, er := p.client.Do(req)
 	if er != nil {
 		err = er
 		return
 	}
 	defer resp.Body.Close()
-	return p.copyBuffer(resp.Body, p.pf, force)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = newStatusError(resp)
+		return
+	}
+	if p.vd.changed(resp, ifRange) {
+		err = ErrRemoteChanged
+		return
+	}
+	err = checkRange(resp, ioff, foff)
+	if err != nil {
+		return
+	}
+	return p.copyBuffer(resp.Body, p.w, force)
+}
+
+// checkRange verifies that the response contains the bytes from
+// ioff till foff, foff being -1 for content of unknown size.
+func checkRange(resp *http.Response, ioff, foff int64) error {
+	if resp.StatusCode != http.StatusPartialContent {
+		switch {
+		case ioff != 0 && foff == -1:
+			return ErrResumeNotSupported
+		case ioff != 0, foff != -1 && resp.ContentLength != foff+1:
+			// whole content is only acceptable if it's
+			// the requested range.
+			return ErrRangeNotSupported
+		}
+		return nil
+	}
+	first, last, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || first != ioff || (foff != -1 && last != foff) {
+		return ErrRangeNotSupported
+	}
+	return nil
+}
+
+// parseContentRange parses the value of a Content-Range header
+// of the form "bytes first-last/total", total is -1 if the
+// complete length is unknown.
+func parseContentRange(v string) (first, last, total int64, ok bool) {
+	if !strings.HasPrefix(v, "bytes ") {
+		return
+	}
+	rng, size, found := strings.Cut(strings.TrimPrefix(v, "bytes "), "/")
+	if !found {
+		return
+	}
+	fs, ls, found := strings.Cut(rng, "-")
+	if !found {
+		return
+	}
+	var err error
+	if first, err = strconv.ParseInt(fs, 10, 64); err != nil {
+		return
+	}
+	if last, err = strconv.ParseInt(ls, 10, 64); err != nil || last < first {
+		return
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total <= last {
+			return
+		}
+	}
+	ok = true
+	return
 }
 
 func (p *Part) copyBuffer(src io.Reader, dst io.Writer, force bool) (slow bool, err error) {
@@ -137,12 +311,16 @@ func (p *Part) copyBuffer(src io.Reader, dst io.Writer, force bool) (slow bool,
 	for {
 		n++
 		if !force && n%10 == 0 {
+			throttled := p.throttled
 			te, err = getSpeed(func() error {
 				return p.copyBufferChunk(src, dst, buf)
 			})
 			if err != nil {
 				break
 			}
+			// time spent waiting for the limiters doesn't
+			// make the part slow.
+			te -= p.throttled - throttled
 			if te > p.etime {
 				slow = true
 				return
@@ -157,11 +335,7 @@ func (p *Part) copyBuffer(src io.Reader, dst io.Writer, force bool) (slow bool,
 	if err == io.EOF {
 		err = nil
 		p.log("%s: part download complete", p.hash)
-		p.wg.Add(1)
-		go func() {
-			p.ofunc(p.hash, p.read)
-			p.wg.Done()
-		}()
+		p.ofunc(p.hash, p.read)
 	}
 	return
 }
@@ -176,12 +350,9 @@ func (p *Part) copyBufferChunk(src io.Reader, dst io.Writer, buf []byte) (err er
 				ew = errors.New("invalid write results")
 			}
 		}
-		p.read += int64(nw)
-		p.wg.Add(1)
-		go func() {
-			p.pfunc(p.hash, nw)
-			p.wg.Done()
-		}()
+		p.wfunc(p.offset+p.read, buf[:nw])
+		p.addRead(int64(nw))
+		p.pfunc(p.hash, nw)
 		if ew != nil {
 			err = ew
 			return
@@ -190,13 +361,29 @@ func (p *Part) copyBufferChunk(src io.Reader, dst io.Writer, buf []byte) (err er
 			err = io.ErrShortWrite
 			return
 		}
+		err = p.throttle(nw)
+		if err != nil {
+			return
+		}
 	}
 	err = er
 	return
 }
 
+// throttle blocks until the limiters allow n more bytes
+// to be downloaded.
+func (p *Part) throttle(n int) error {
+	for _, l := range p.limiters {
+		waited, err := l.wait(p.ctx, n)
+		p.throttled += waited
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *Part) compile() (read, written int64, err error) {
-	wg := &sync.WaitGroup{}
 	// take the reader to origin from end
 	p.pf.Seek(0, 0)
 
@@ -214,11 +401,7 @@ func (p *Part) compile() (read, written int64, err error) {
 				}
 			}
 			written += int64(nw)
-			wg.Add(1)
-			go func() {
-				p.cfunc(p.hash, nw)
-				wg.Done()
-			}()
+			p.cfunc(p.hash, nw)
 			if ew != nil {
 				err = ew
 				break
@@ -236,7 +419,93 @@ func (p *Part) compile() (read, written int64, err error) {
 			break
 		}
 	}
-	wg.Wait()
+	return
+}
+
+// absorb stops the part so that it can be merged into the
+// part before it. It reports false if the part is already
+// done with downloading.
+func (p *Part) absorb() bool {
+	p.mu.Lock()
+	if p.done {
+		p.mu.Unlock()
+		return false
+	}
+	p.absorbed = true
+	p.mu.Unlock()
+	p.cancel()
+	<-p.stopped
+	return true
+}
+
+func (p *Part) addRead(n int64) {
+	p.mu.Lock()
+	p.read += n
+	p.mu.Unlock()
+}
+
+func (p *Part) setFoff(foff int64) {
+	p.mu.Lock()
+	p.foff = foff
+	p.mu.Unlock()
+}
+
+// remaining returns the number of bytes the part has yet to
+// download, it's safe for use by other goroutines.
+func (p *Part) remaining() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.foff - (p.offset + p.read) + 1
+}
+
+// progress returns the number of bytes downloaded by the part
+// and its final offset, it's safe for use by other goroutines.
+func (p *Part) progress() (read, foff int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.read, p.foff
+}
+
+// release marks the part as done with downloading and
+// reports whether it has been absorbed by another part.
+func (p *Part) release() (absorbed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	if p.absorbed {
+		close(p.stopped)
+	}
+	return p.absorbed
+}
+
+// merge appends the bytes downloaded by the absorbed part
+// next to the part and extends the part till the final
+// offset of next.
+func (p *Part) merge(next *Part) (err error) {
+	if next.pf != nil {
+		_, err = next.pf.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.CopyN(p.pf, next.pf, next.read)
+		if err != nil {
+			return
+		}
+		next.close()
+		er := os.Remove(next.getFileName())
+		if er != nil {
+			p.log("%s: remove: %s", next.hash, er.Error())
+		}
+	}
+	p.mu.Lock()
+	p.read += next.read
+	p.foff = next.foff
+	p.mu.Unlock()
+	if p.pf == nil {
+		// direct parts continue writing from where
+		// the absorbed part stopped.
+		p.w = &offsetWriter{p.f, p.offset + p.read}
+	}
 	return
 }
 
@@ -262,11 +531,13 @@ func (p *Part) setHash() {
 
 func (p *Part) createPartFile() (err error) {
 	p.pf, err = os.Create(p.getFileName())
+	p.w = p.pf
 	return
 }
 
 func (p *Part) openPartFile() (err error) {
 	p.pf, err = os.OpenFile(p.getFileName(), os.O_RDWR, 0666)
+	p.w = p.pf
 	return
 }
 
@@ -286,7 +557,17 @@ func (p *Part) getFileName() string {
 	return getFileName(p.preName, p.hash)
 }
 
+// close flushes the part file to the disk and closes it.
 func (p *Part) close() error {
+	if p.pf == nil {
+		// stream and direct parts don't have a part file.
+		return nil
+	}
+	err := p.pf.Sync()
+	if err != nil {
+		p.pf.Close()
+		return err
+	}
 	return p.pf.Close()
 }
 
@@ -294,6 +575,18 @@ func (p *Part) log(s string, a ...any) {
 	p.l.Printf(s+"\n", a...)
 }
 
+// offsetWriter writes to f sequentially starting at off.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(b []byte) (n int, err error) {
+	n, err = w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return
+}
+
 func (p *Part) String() string {
 	return p.hash
 }
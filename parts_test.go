@@ -0,0 +1,36 @@
+package warplib
+
+import "testing"
+
+func Test_parseContentRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		v         string
+		wantFirst int64
+		wantLast  int64
+		wantTotal int64
+		wantOk    bool
+	}{
+		{"complete", "bytes 0-499/1234", 0, 499, 1234, true},
+		{"unknown total", "bytes 500-999/*", 500, 999, -1, true},
+		{"unsatisfied", "bytes */1234", 0, 0, 0, false},
+		{"last before first", "bytes 10-5/20", 0, 0, 0, false},
+		{"last beyond total", "bytes 0-20/20", 0, 0, 0, false},
+		{"other unit", "items 0-5/10", 0, 0, 0, false},
+		{"empty", "", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, total, ok := parseContentRange(tt.v)
+			if ok != tt.wantOk {
+				t.Fatalf("parseContentRange() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && (first != tt.wantFirst || last != tt.wantLast || total != tt.wantTotal) {
+				t.Errorf(
+					"parseContentRange() = %d, %d, %d, want %d, %d, %d",
+					first, last, total, tt.wantFirst, tt.wantLast, tt.wantTotal,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package warplib
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProgressSnapshot is the progress of a download at the time it
+// was taken.
+type ProgressSnapshot struct {
+	// Downloaded is the number of bytes downloaded so far and
+	// Total the size of the file, -1 if it's unknown.
+	Downloaded, Total int64
+	// Speed is the download speed in bytes per second over
+	// the last DEF_SPEED_INTERVAL or more, AvgSpeed is its
+	// moving average over about DEF_SPEED_WINDOW.
+	Speed, AvgSpeed int64
+	// ETA is the time left at AvgSpeed, -1 if it can't be
+	// told.
+	ETA time.Duration
+	// Connections is the number of connections in use.
+	Connections int
+	// Parts is the progress of the parts, ordered by their
+	// offsets.
+	Parts []PartProgress
+}
+
+// PartProgress is the progress of the part with Hash, which
+// downloads the bytes from Ioff till Foff.
+type PartProgress struct {
+	Hash       string
+	Ioff, Foff int64
+	Downloaded int64
+}
+
+// Progress returns a snapshot of the progress of the download,
+// it's safe for use while the download runs. Speeds are only
+// known while it runs.
+func (d *Downloader) Progress() ProgressSnapshot {
+	d.mu.Lock()
+	// the size of a stream is set once it ends.
+	total := d.contentLength.v()
+	d.mu.Unlock()
+	fetched := d.fetched.Load()
+	p := ProgressSnapshot{
+		Downloaded: d.resumed.Load() + fetched,
+		Total:      total,
+	}
+	if d.isRunning() {
+		p.Speed, p.AvgSpeed = d.meter.sample(time.Now(), fetched)
+		p.Connections = d.conns.count()
+		_, parts := d.active.Dump()
+		for _, part := range parts {
+			read, foff := part.progress()
+			p.Parts = append(p.Parts, PartProgress{part.hash, part.offset, foff, read})
+		}
+		sortParts(p.Parts)
+	}
+	p.ETA = getETA(p.Total-p.Downloaded, p.AvgSpeed)
+	return p
+}
+
+// Progress returns a snapshot of the progress of the item, which
+// is the one of its download while it runs.
+func (i *Item) Progress() ProgressSnapshot {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if d := i.dAlloc; d != nil && d.isRunning() {
+		return d.Progress()
+	}
+	p := ProgressSnapshot{
+		Downloaded: i.Downloaded.v(),
+		Total:      i.TotalSize.v(),
+	}
+	for ioff, part := range i.Parts {
+		p.Parts = append(p.Parts, PartProgress{part.Hash, ioff, part.FinalOffset, part.Downloaded})
+	}
+	sortParts(p.Parts)
+	p.ETA = getETA(p.Total-p.Downloaded, 0)
+	return p
+}
+
+func sortParts(parts []PartProgress) {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Ioff < parts[j].Ioff
+	})
+}
+
+// getETA returns the time it takes to download rem bytes at speed
+// bytes per second, -1 if it can't be told.
+func getETA(rem, speed int64) time.Duration {
+	switch {
+	case rem <= 0:
+		return 0
+	case speed <= 0:
+		return -1
+	}
+	return time.Duration(float64(rem) / float64(speed) * float64(time.Second))
+}
+
+// speedMeter measures the speed of a download from samples of
+// its byte count, it's safe for concurrent use.
+type speedMeter struct {
+	mu sync.Mutex
+	// time and byte count of the last sample
+	at    time.Time
+	bytes int64
+	// speed and its moving average, avg is set once
+	// primed is.
+	speed, avg float64
+	primed     bool
+}
+
+// start takes the first sample, once the download starts.
+func (s *speedMeter) start(now time.Time, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.at, s.bytes = now, bytes
+}
+
+// sample takes a sample if DEF_SPEED_INTERVAL has passed since
+// the last one and returns the speeds measured so far.
+func (s *speedMeter) sample(now time.Time, bytes int64) (speed, avg int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.at.IsZero() {
+		return
+	}
+	dt := now.Sub(s.at)
+	if dt < DEF_SPEED_INTERVAL {
+		return int64(s.speed), int64(s.avg)
+	}
+	s.speed = float64(bytes-s.bytes) / dt.Seconds()
+	if s.primed {
+		// samples are weighted by the time they cover so
+		// that the average doesn't depend on how often
+		// it's polled.
+		a := 1 - math.Exp(-dt.Seconds()/DEF_SPEED_WINDOW.Seconds())
+		s.avg += a * (s.speed - s.avg)
+	} else {
+		s.avg, s.primed = s.speed, true
+	}
+	s.at, s.bytes = now, bytes
+	return int64(s.speed), int64(s.avg)
+}
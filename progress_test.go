@@ -0,0 +1,133 @@
+package warplib
+
+import (
+	"crypto/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpeedMeter(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	type sample struct {
+		after      time.Duration
+		bytes      int64
+		speed, avg int64
+	}
+	tests := []struct {
+		name    string
+		samples []sample
+	}{
+		{"too soon", []sample{{100 * time.Millisecond, 1000, 0, 0}}},
+		{"first sample", []sample{{time.Second, 1000, 1000, 1000}}},
+		{"cached", []sample{
+			{time.Second, 1000, 1000, 1000},
+			{time.Second + 100*time.Millisecond, 5000, 1000, 1000},
+		}},
+		{"stalled", []sample{
+			{time.Second, 1000, 1000, 1000},
+			{11 * time.Second, 1000, 0, 367},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s speedMeter
+			s.start(t0, 0)
+			for i, sm := range tt.samples {
+				speed, avg := s.sample(t0.Add(sm.after), sm.bytes)
+				if speed != sm.speed || avg != sm.avg {
+					t.Errorf("sample %d: got %d, %d, want %d, %d", i, speed, avg, sm.speed, sm.avg)
+				}
+			}
+		})
+	}
+}
+
+func TestGetETA(t *testing.T) {
+	tests := []struct {
+		rem, speed int64
+		want       time.Duration
+	}{
+		{0, 0, 0},
+		{100, 0, -1},
+		{100, 50, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := getETA(tt.rem, tt.speed); got != tt.want {
+			t.Errorf("getETA(%d, %d) = %v, want %v", tt.rem, tt.speed, got, tt.want)
+		}
+	}
+}
+
+func TestDownloader_Progress(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.Read(data)
+	srv := newRangeServer(t, data, 5*time.Millisecond)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	polled := make(chan bool)
+	go func() {
+		// snapshots are taken while the download runs.
+		var last int64
+		var seen bool
+		for {
+			select {
+			case <-done:
+				polled <- seen
+				return
+			case <-time.After(time.Millisecond):
+			}
+			p := d.Progress()
+			if p.Downloaded < last {
+				t.Errorf("progress went back from %d to %d", last, p.Downloaded)
+			}
+			last = p.Downloaded
+			seen = seen || (p.Connections > 0 && len(p.Parts) > 0)
+		}
+	}()
+	err = d.Start()
+	close(done)
+	if !<-polled {
+		t.Error("no snapshot had connections and parts")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ProgressSnapshot{Downloaded: int64(len(data)), Total: int64(len(data))}
+	if p := d.Progress(); !reflect.DeepEqual(p, want) {
+		t.Errorf("progress of the complete download is %+v, want %+v", p, want)
+	}
+}
+
+func TestItem_Progress(t *testing.T) {
+	item := &Item{
+		mu:         new(sync.RWMutex),
+		TotalSize:  100,
+		Downloaded: 30,
+		Parts: map[int64]*ItemPart{
+			50: {Hash: "b", FinalOffset: 99, Downloaded: 10},
+			0:  {Hash: "a", FinalOffset: 49, Downloaded: 20},
+		},
+	}
+	want := ProgressSnapshot{
+		Downloaded: 30,
+		Total:      100,
+		ETA:        -1,
+		Parts: []PartProgress{
+			{"a", 0, 49, 20},
+			{"b", 50, 99, 10},
+		},
+	}
+	if p := item.Progress(); !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
@@ -0,0 +1,306 @@
+package warplib
+
+import "net/http"
+
+// Optional fields of a queued download
+type EnqueueOpts struct {
+	// Priority of the download, downloads of higher
+	// priority are started first.
+	Priority int
+	// Client is used to download the item, a new client
+	// is used if it's nil.
+	Client *http.Client
+	// ResumeOpts are used to resume the item once its
+	// turn comes.
+	ResumeOpts *ResumeDownloadOpts
+	// ErrorHandler is called if the download fails to be
+	// started or returns an error.
+	ErrorHandler ErrorHandlerFunc
+}
+
+type queueEntry struct {
+	hash string
+	opts EnqueueOpts
+}
+
+// resumeOpts returns a copy of the resume options of the entry,
+// handlers are copied too as the downloader fills in the missing
+// ones.
+func (e *queueEntry) resumeOpts() *ResumeDownloadOpts {
+	ropts := ResumeDownloadOpts{}
+	if e.opts.ResumeOpts != nil {
+		ropts = *e.opts.ResumeOpts
+	}
+	if ropts.Handlers != nil {
+		h := *ropts.Handlers
+		ropts.Handlers = &h
+	}
+	return &ropts
+}
+
+// Enqueue queues the item with hash to be downloaded once one of
+// the download slots of the manager is free, see
+// SetMaxConcurrentDownloads.
+func (m *Manager) Enqueue(hash string, opts *EnqueueOpts) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if opts == nil {
+		opts = &EnqueueOpts{}
+	}
+	item := m.lookupItem(hash)
+	if item == nil {
+		return ErrDownloadNotFound
+	}
+	if item.GetState() == ItemStateCompleted {
+		return ErrDownloadComplete
+	}
+	e := &queueEntry{hash: hash, opts: *opts}
+	if e.opts.Client == nil {
+		e.opts.Client = &http.Client{}
+	}
+	if e.opts.ErrorHandler == nil {
+		e.opts.ErrorHandler = func(string, error) {}
+	}
+	m.qmu.Lock()
+	if m.queueIndex(hash) != -1 || m.running[hash] != nil {
+		m.qmu.Unlock()
+		return ErrDownloadQueued
+	}
+	err := item.setState(ItemStateQueued, nil)
+	if err != nil {
+		m.qmu.Unlock()
+		return err
+	}
+	m.insert(e)
+	m.qmu.Unlock()
+	m.UpdateItem(item)
+	m.startQueued()
+	return nil
+}
+
+// Dequeue removes the item with hash from the queue, it doesn't
+// stop the item if it's already being downloaded.
+func (m *Manager) Dequeue(hash string) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	i := m.queueIndex(hash)
+	if i == -1 {
+		return ErrDownloadNotQueued
+	}
+	m.queue = append(m.queue[:i], m.queue[i+1:]...)
+	if item := m.lookupItem(hash); item != nil {
+		state := ItemStatePending
+		if item.Downloaded != 0 {
+			state = ItemStatePaused
+		}
+		m.setItemState(item, state, nil)
+		m.UpdateItem(item)
+	}
+	return nil
+}
+
+// SetPriority changes the priority of the queued item with hash,
+// moving it behind the items of the same or higher priority.
+func (m *Manager) SetPriority(hash string, priority int) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	i := m.queueIndex(hash)
+	if i == -1 {
+		return ErrDownloadNotQueued
+	}
+	e := m.queue[i]
+	m.queue = append(m.queue[:i], m.queue[i+1:]...)
+	e.opts.Priority = priority
+	m.insert(e)
+	return nil
+}
+
+// MoveInQueue moves the queued item with hash to the position pos
+// of the queue regardless of its priority, pos is clamped to the
+// bounds of the queue.
+func (m *Manager) MoveInQueue(hash string, pos int) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	i := m.queueIndex(hash)
+	if i == -1 {
+		return ErrDownloadNotQueued
+	}
+	e := m.queue[i]
+	m.queue = append(m.queue[:i], m.queue[i+1:]...)
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(m.queue) {
+		pos = len(m.queue)
+	}
+	m.insertAt(e, pos)
+	return nil
+}
+
+// GetQueue returns the hashes of the queued items in the order
+// they are going to be downloaded.
+func (m *Manager) GetQueue() []string {
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	hashes := make([]string, len(m.queue))
+	for i, e := range m.queue {
+		hashes[i] = e.hash
+	}
+	return hashes
+}
+
+// SetMaxConcurrentDownloads sets the maximum number of queued
+// items downloaded at the same time, 0 means no limit.
+func (m *Manager) SetMaxConcurrentDownloads(n int) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if n < 0 {
+		n = 0
+	}
+	m.qmu.Lock()
+	m.maxDownloads = n
+	m.qmu.Unlock()
+	m.startQueued()
+	return nil
+}
+
+func (m *Manager) queueIndex(hash string) int {
+	for i, e := range m.queue {
+		if e.hash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// insert puts e behind the entries of the same or higher priority.
+func (m *Manager) insert(e *queueEntry) {
+	pos := len(m.queue)
+	for i, qe := range m.queue {
+		if qe.opts.Priority < e.opts.Priority {
+			pos = i
+			break
+		}
+	}
+	m.insertAt(e, pos)
+}
+
+func (m *Manager) insertAt(e *queueEntry, pos int) {
+	m.queue = append(m.queue, nil)
+	copy(m.queue[pos+1:], m.queue[pos:])
+	m.queue[pos] = e
+}
+
+// startQueued starts the queued items while there are free
+// download slots and downloads aren't paused by the schedule.
+func (m *Manager) startQueued() {
+	for {
+		if m.isPaused() {
+			return
+		}
+		m.qmu.Lock()
+		if len(m.queue) == 0 || (m.maxDownloads != 0 && len(m.running) >= m.maxDownloads) {
+			m.qmu.Unlock()
+			return
+		}
+		e := m.queue[0]
+		m.queue = m.queue[1:]
+		m.running[e.hash] = e
+		m.qmu.Unlock()
+		m.startEntry(e)
+	}
+}
+
+func (m *Manager) startEntry(e *queueEntry) {
+	item, err := m.ResumeDownload(e.opts.Client, e.hash, e.resumeOpts())
+	if err != nil {
+		m.qmu.Lock()
+		delete(m.running, e.hash)
+		m.qmu.Unlock()
+		if item = m.lookupItem(e.hash); item != nil {
+			m.setItemState(item, ItemStateFailed, err)
+			m.UpdateItem(item)
+		}
+		e.opts.ErrorHandler(e.hash, err)
+		return
+	}
+	go func() {
+		err := item.Resume()
+		if err != nil {
+			e.opts.ErrorHandler(e.hash, err)
+		}
+		m.finishQueued(e.hash)
+	}()
+}
+
+// finishQueued frees the download slot of the item with hash and
+// starts the next queued item. Items stopped by the schedule are
+// put back at the front of the queue.
+func (m *Manager) finishQueued(hash string) {
+	paused := m.isPaused()
+	item := m.lookupItem(hash)
+	m.qmu.Lock()
+	e := m.running[hash]
+	if e == nil {
+		m.qmu.Unlock()
+		return
+	}
+	delete(m.running, hash)
+	requeue := paused && item != nil && item.setState(ItemStateQueued, nil) == nil
+	if requeue {
+		m.insertAt(e, 0)
+	}
+	m.qmu.Unlock()
+	if requeue {
+		m.UpdateItem(item)
+	}
+	m.startQueued()
+}
+
+// unqueue drops the item with hash from the queue and frees its
+// download slot, it reports whether a slot was freed.
+func (m *Manager) unqueue(hash string) (freed bool) {
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	if i := m.queueIndex(hash); i != -1 {
+		m.queue = append(m.queue[:i], m.queue[i+1:]...)
+	}
+	if m.running[hash] != nil {
+		delete(m.running, hash)
+		freed = true
+	}
+	return
+}
+
+// isQueued reports whether the item with hash is queued or
+// being downloaded by the queue.
+func (m *Manager) isQueued(hash string) bool {
+	m.qmu.Lock()
+	defer m.qmu.Unlock()
+	return m.running[hash] != nil || m.queueIndex(hash) != -1
+}
+
+// lookupItem returns the item with hash, unlike GetItem it
+// leaves the state of an item being downloaded untouched.
+func (m *Manager) lookupItem(hash string) *Item {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.items[hash]
+}
+
+func (m *Manager) isPaused() bool {
+	m.smu.Lock()
+	defer m.smu.Unlock()
+	return m.paused
+}
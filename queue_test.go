@@ -0,0 +1,143 @@
+package warplib
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newPausedManager returns a manager with incomplete items of
+// hashes, downloads are paused so that queued items aren't
+// started.
+func newPausedManager(t *testing.T, hashes ...string) *Manager {
+	m, err := NewManager(&Config{ConfigDir: t.TempDir()}, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.paused = true
+	for _, hash := range hashes {
+		m.items[hash] = &Item{Hash: hash, TotalSize: 100, State: ItemStatePending, mu: m.mu}
+	}
+	m.items["done"] = &Item{Hash: "done", TotalSize: 100, Downloaded: 100, State: ItemStateCompleted, mu: m.mu}
+	return m
+}
+
+func TestManager_Enqueue(t *testing.T) {
+	m := newPausedManager(t, "a", "b", "c", "d")
+	steps := []struct {
+		hash     string
+		priority int
+		want     []string
+		wantErr  error
+	}{
+		{"a", 0, []string{"a"}, nil},
+		{"b", 0, []string{"a", "b"}, nil},
+		{"c", 1, []string{"c", "a", "b"}, nil},
+		{"d", 1, []string{"c", "d", "a", "b"}, nil},
+		{"a", 2, []string{"c", "d", "a", "b"}, ErrDownloadQueued},
+		{"done", 0, []string{"c", "d", "a", "b"}, ErrDownloadComplete},
+		{"missing", 0, []string{"c", "d", "a", "b"}, ErrDownloadNotFound},
+	}
+	for _, step := range steps {
+		err := m.Enqueue(step.hash, &EnqueueOpts{Priority: step.priority})
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("Enqueue(%q) error = %v, want %v", step.hash, err, step.wantErr)
+		}
+		if got := m.GetQueue(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("Enqueue(%q): GetQueue() = %v, want %v", step.hash, got, step.want)
+		}
+	}
+}
+
+func TestManager_reorderQueue(t *testing.T) {
+	m := newPausedManager(t, "a", "b", "c")
+	for _, hash := range []string{"a", "b", "c"} {
+		if err := m.Enqueue(hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	steps := []struct {
+		name    string
+		op      func() error
+		want    []string
+		wantErr error
+	}{
+		{"raise priority", func() error { return m.SetPriority("c", 1) }, []string{"c", "a", "b"}, nil},
+		{"lower priority", func() error { return m.SetPriority("c", 0) }, []string{"a", "b", "c"}, nil},
+		{"move to front", func() error { return m.MoveInQueue("b", 0) }, []string{"b", "a", "c"}, nil},
+		{"move past end", func() error { return m.MoveInQueue("b", 10) }, []string{"a", "c", "b"}, nil},
+		{"dequeue", func() error { return m.Dequeue("c") }, []string{"a", "b"}, nil},
+		{"dequeue missing", func() error { return m.Dequeue("c") }, []string{"a", "b"}, ErrDownloadNotQueued},
+		{"move missing", func() error { return m.MoveInQueue("c", 0) }, []string{"a", "b"}, ErrDownloadNotQueued},
+	}
+	for _, step := range steps {
+		if err := step.op(); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: error = %v, want %v", step.name, err, step.wantErr)
+		}
+		if got := m.GetQueue(); !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s: GetQueue() = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestManager_Flush_queue(t *testing.T) {
+	m := newPausedManager(t, "a", "b")
+	for _, hash := range []string{"a", "b"} {
+		if err := m.Enqueue(hash, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetQueue(); len(got) != 0 {
+		t.Errorf("GetQueue() = %v after Flush(), want empty", got)
+	}
+}
+
+// TestManager_Enqueue_added starts an item added with AddDownload
+// through the queue, the download it was added with is replaced
+// and has to be closed.
+func TestManager_Enqueue_added(t *testing.T) {
+	srv := newRangeServer(t, bytes.Repeat([]byte("warp"), 1024), 0)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	item := m.GetItem(d.hash)
+	if err = m.Enqueue(d.hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !d.IsStopped() {
+		t.Error("replaced download wasn't stopped")
+	}
+	if _, err = d.lw.Write([]byte("log")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write to the log of the replaced download error = %v, want %v", err, os.ErrClosed)
+	}
+	if err = d.Start(); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("Start() of replaced download error = %v, want %v", err, ErrDownloadStopped)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for item.GetState() != ItemStateCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued item is %s, want %s", item.GetState(), ItemStateCompleted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
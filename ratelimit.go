@@ -0,0 +1,111 @@
+package warplib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the number of bytes
+// downloaded per second. A single RateLimiter can be shared by
+// several downloads to cap their combined speed.
+//
+// A nil or zero rate RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	mu sync.Mutex
+	// bytes per second, 0 for no limit
+	rate int64
+	// available bytes, negative when bytes are
+	// reserved ahead of time
+	tokens float64
+	last   time.Time
+	// changed is closed when the rate is changed
+	// to wake up the waiting parts
+	changed chan struct{}
+}
+
+// NewRateLimiter creates a RateLimiter allowing rate bytes
+// per second, 0 disables the limit.
+func NewRateLimiter(rate int64) *RateLimiter {
+	l := &RateLimiter{changed: make(chan struct{})}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the allowed bytes per second, it can be
+// called while downloads are running. 0 disables the limit.
+func (l *RateLimiter) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	// bytes reserved with the older rate are forgiven.
+	l.tokens = 0
+	l.last = time.Now()
+	if l.changed != nil {
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the allowed bytes per second, 0 if the
+// limit is disabled.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// reserve takes n bytes from the bucket and returns the time
+// to wait before using them. The bucket holds a second worth
+// of bytes at most.
+func (l *RateLimiter) reserve(n int, now time.Time) (delay time.Duration, changed <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return
+	}
+	rate := float64(l.rate)
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		l.last = now
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return
+	}
+	delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	changed = l.changed
+	return
+}
+
+// wait blocks until n bytes are allowed to be used or ctx is
+// done, it returns the time spent waiting.
+func (l *RateLimiter) wait(ctx context.Context, n int) (waited time.Duration, err error) {
+	if l == nil || n <= 0 {
+		return
+	}
+	tn := time.Now()
+	delay, changed := l.reserve(n, tn)
+	if delay <= 0 {
+		return
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-changed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited = time.Since(tn)
+	return
+}
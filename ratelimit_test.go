@@ -0,0 +1,47 @@
+package warplib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_reserve(t *testing.T) {
+	l := NewRateLimiter(1000)
+	start := l.last
+	tests := []struct {
+		name    string
+		n       int
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{"empty bucket", 500, 0, 500 * time.Millisecond},
+		{"reserved ahead", 500, 0, time.Second},
+		{"refilled", 250, time.Second, 250 * time.Millisecond},
+		{"capped to a second", 1000, 10 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		got, _ := l.reserve(tt.n, start.Add(tt.elapsed))
+		if got != tt.want {
+			t.Errorf("%s: reserve() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter_SetRate(t *testing.T) {
+	l := NewRateLimiter(1000)
+	now := l.last
+	_, changed := l.reserve(2000, now)
+	l.SetRate(0)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("SetRate() didn't wake up the waiting parts")
+	}
+	if got, _ := l.reserve(1<<30, now); got != 0 {
+		t.Errorf("reserve() = %v without a limit, want 0", got)
+	}
+	var nl *RateLimiter
+	if got := nl.Rate(); got != 0 {
+		t.Errorf("Rate() = %d for nil limiter, want 0", got)
+	}
+}
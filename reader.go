@@ -16,6 +16,8 @@ func NewProxyReader(reader io.Reader, callback func(n int)) *ProxyReader {
 
 func (p *ProxyReader) Read(b []byte) (n int, err error) {
 	n, err = p.r.Read(b)
-	go p.c(n)
+	if n > 0 {
+		p.c(n)
+	}
 	return
 }
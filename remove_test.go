@@ -0,0 +1,154 @@
+package warplib
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManager_RemoveDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("warp"), int(MB))
+	srv := newRangeServer(t, data, 5*time.Millisecond)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	progress := make(chan struct{}, 1)
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+		Handlers: &Handlers{
+			DownloadProgressHandler: func(string, int) {
+				select {
+				case progress <- struct{}{}:
+				default:
+				}
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan error, 1)
+	go func() { started <- d.Start() }()
+	<-progress
+	if err = m.RemoveDownload(d.hash, &RemoveDownloadOpts{DeleteFile: true}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.done:
+	default:
+		t.Fatal("RemoveDownload() returned before the download stopped")
+	}
+	select {
+	case err = <-started:
+		if err != nil {
+			t.Errorf("Start() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start() didn't return after RemoveDownload()")
+	}
+	if m.GetItem(d.hash) != nil {
+		t.Error("item is still managed after RemoveDownload()")
+	}
+	if _, err = os.Stat(d.dlPath); !os.IsNotExist(err) {
+		t.Errorf("download data still exists: %v", err)
+	}
+	if err = m.RemoveDownload(d.hash, nil); !errors.Is(err, ErrDownloadNotFound) {
+		t.Errorf("RemoveDownload() of removed item error = %v, want %v", err, ErrDownloadNotFound)
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- m.Flush() }()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush() is still waiting for the removed download")
+	}
+}
+
+func TestManager_RemoveDownload_notStarted(t *testing.T) {
+	srv := newRangeServer(t, bytes.Repeat([]byte("warp"), 1024), 0)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            cfg,
+		DownloadDirectory: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.AddDownload(d, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a download added but never started isn't waited for.
+	if err = m.FlushOne(d.hash); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Start(); !errors.Is(err, ErrDownloadStopped) {
+		t.Errorf("Start() of removed download error = %v, want %v", err, ErrDownloadStopped)
+	}
+	if m.GetItem(d.hash) != nil {
+		t.Error("removed item was saved again")
+	}
+}
+
+// TestManager_RemoveDownload_fileStore removes a download while
+// another one runs, the store encodes the running item while it
+// deletes the removed one.
+func TestManager_RemoveDownload_fileStore(t *testing.T) {
+	data := bytes.Repeat([]byte("warp"), int(MB)/2)
+	srv := newRangeServer(t, data, time.Millisecond)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewFileStore(cfg.userdataPath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.SetFlushInterval(time.Hour)
+	progress := make(chan struct{}, 1)
+	var ds []*Downloader
+	for i := 0; i < 2; i++ {
+		d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+			Config:            cfg,
+			DownloadDirectory: t.TempDir(),
+			MaxConnections:    1,
+			Handlers: &Handlers{
+				DownloadProgressHandler: func(string, int) {
+					select {
+					case progress <- struct{}{}:
+					default:
+					}
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = m.AddDownload(d, nil); err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	started := make(chan error, 1)
+	go func() { started <- ds[0].Start() }()
+	<-progress
+	if err = m.RemoveDownload(ds[1].hash, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-started; err != nil {
+		t.Fatal(err)
+	}
+}
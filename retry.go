@@ -0,0 +1,180 @@
+package warplib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how failed part downloads are retried.
+// Zero fields are set to their defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of consecutive failed
+	// attempts after which a part is given up. Attempts are
+	// counted afresh once a part makes progress.
+	// Setting it to 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, it
+	// is doubled for every following retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+	// Jitter randomizes the delay by up to this fraction of
+	// it, in range [0, 1].
+	Jitter float64
+	// MaxRetryAfter caps the delay asked by the server through
+	// the Retry-After header.
+	MaxRetryAfter time.Duration
+}
+
+func (r *RetryPolicy) setDefault() {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DEF_MAX_ATTEMPTS
+	}
+	if r.InitialBackoff <= 0 {
+		r.InitialBackoff = DEF_INITIAL_BACKOFF
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = DEF_MAX_BACKOFF
+	}
+	if r.Jitter < 0 {
+		r.Jitter = 0
+	}
+	if r.Jitter > 1 {
+		r.Jitter = 1
+	}
+	if r.MaxRetryAfter <= 0 {
+		r.MaxRetryAfter = DEF_MAX_RETRY_AFTER
+	}
+}
+
+// backoff returns the delay before the nth retry.
+func (r *RetryPolicy) backoff(n int) (delay time.Duration) {
+	delay = r.InitialBackoff
+	for i := 1; i < n && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	if r.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * r.Jitter * float64(delay))
+	}
+	return
+}
+
+// delay returns the delay before the nth retry of a part which
+// failed with err, it reports whether the server pushed back
+// on the part. The delay asked by a server which pushed back is
+// honored up to MaxRetryAfter.
+func (r *RetryPolicy) delay(n int, err error) (delay time.Duration, pushback bool) {
+	delay = r.backoff(n)
+	var se *StatusError
+	if !errors.As(err, &se) || !se.isPushback() {
+		return
+	}
+	after := se.RetryAfter
+	if after > r.MaxRetryAfter {
+		after = r.MaxRetryAfter
+	}
+	if after > delay {
+		delay = after
+	}
+	return delay, true
+}
+
+// StatusError is returned when a part request is answered
+// with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay asked by the server
+	// through the Retry-After header.
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// isPushback reports whether the server rejected the request
+// due to too many requests or connections.
+func (e *StatusError) isPushback() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status: %s", e.Status)
+}
+
+// parseRetryAfter parses the value of a Retry-After header,
+// which is either a number of seconds or an HTTP date.
+func parseRetryAfter(v string, now time.Time) (delay time.Duration) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		switch {
+		case secs > int64(_MAX_RETRY_AFTER/time.Second):
+			delay = _MAX_RETRY_AFTER
+		case secs > 0:
+			delay = time.Duration(secs) * time.Second
+		}
+		return
+	}
+	t, err := http.ParseTime(v)
+	if err == nil && t.After(now) {
+		delay = t.Sub(now)
+		if delay > _MAX_RETRY_AFTER {
+			delay = _MAX_RETRY_AFTER
+		}
+	}
+	return
+}
+
+// isRetryable reports whether a part download which failed
+// with err is worth retrying.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return true
+		}
+		return se.StatusCode >= 500
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, io.EOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNABORTED),
+		errors.Is(err, syscall.EPIPE):
+		return true
+	}
+	return false
+}
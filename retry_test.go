@@ -0,0 +1,116 @@
+package warplib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"timeout", &url.Error{Op: "Get", URL: "/", Err: timeoutError{}}, true},
+		{"connection reset", fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{"unexpected eof", io.ErrUnexpectedEOF, true},
+		{"too many requests", &StatusError{StatusCode: 429}, true},
+		{"bad gateway", &StatusError{StatusCode: 502}, true},
+		{"not found", &StatusError{StatusCode: 404}, false},
+		{"stopped", &url.Error{Op: "Get", URL: "/", Err: context.Canceled}, false},
+		{"disk full", &os.PathError{Op: "write", Path: "warp.dl", Err: syscall.ENOSPC}, false},
+		{"resume not supported", ErrResumeNotSupported, false},
+		{"unknown", errors.New("unknown"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	r := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	r.setDefault()
+	tests := []struct {
+		n    int
+		want time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{10, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.n), func(t *testing.T) {
+			if got := r.backoff(tt.n); got != tt.want {
+				t.Errorf("RetryPolicy.backoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		v    string
+		want time.Duration
+	}{
+		{"empty", "", 0},
+		{"seconds", "120", 2 * time.Minute},
+		{"negative seconds", "-5", 0},
+		{"http date", "Thu, 01 Jun 2023 12:00:30 GMT", 30 * time.Second},
+		{"past http date", "Thu, 01 Jun 2023 11:00:00 GMT", 0},
+		{"invalid", "soon", 0},
+		{"huge seconds", "99999999999999", _MAX_RETRY_AFTER},
+		{"far http date", "Thu, 01 Jun 2123 12:00:00 GMT", _MAX_RETRY_AFTER},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.v, now); got != tt.want {
+				t.Errorf("parseRetryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy_delay(t *testing.T) {
+	r := RetryPolicy{InitialBackoff: time.Second, MaxRetryAfter: time.Minute}
+	r.setDefault()
+	tests := []struct {
+		name         string
+		err          error
+		want         time.Duration
+		wantPushback bool
+	}{
+		{"bad gateway", &StatusError{StatusCode: 502, RetryAfter: 10 * time.Second}, time.Second, false},
+		{"pushback", &StatusError{StatusCode: 503}, time.Second, true},
+		{"retry after", &StatusError{StatusCode: 429, RetryAfter: 10 * time.Second}, 10 * time.Second, true},
+		{"retry after capped", &StatusError{StatusCode: 503, RetryAfter: time.Hour}, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, pushback := r.delay(1, tt.err)
+			if got != tt.want || pushback != tt.wantPushback {
+				t.Errorf("RetryPolicy.delay() = %v, %v, want %v, %v", got, pushback, tt.want, tt.wantPushback)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package warplib
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Clock tells the time to the schedule of the Manager, it
+// can be replaced to drive the schedule deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// TimeOfDay is the number of minutes past midnight.
+type TimeOfDay int
+
+// ParseTimeOfDay parses a time of day in the 24-hour "hh:mm"
+// format, "24:00" being the end of the day.
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	if len(s) != 5 || s[2] != ':' {
+		return 0, ErrInvalidTimeOfDay
+	}
+	var d [4]int
+	for i, c := range s[:2] + s[3:] {
+		if c < '0' || c > '9' {
+			return 0, ErrInvalidTimeOfDay
+		}
+		d[i] = int(c - '0')
+	}
+	h, m := d[0]*10+d[1], d[2]*10+d[3]
+	if m > 59 || h*60+m > 24*60 {
+		return 0, ErrInvalidTimeOfDay
+	}
+	return TimeOfDay(h*60 + m), nil
+}
+
+func (t TimeOfDay) String() string {
+	return fmt.Sprintf("%02d:%02d", t/60, t%60)
+}
+
+// ScheduleRule applies a speed limit or pauses the downloads
+// on the given days between Start and End. A rule with equal
+// Start and End covers the whole day, while a rule with End
+// before Start covers the time till midnight and the time
+// after it.
+type ScheduleRule struct {
+	// Days the rule applies to, every day if it's empty.
+	Days       []time.Weekday
+	Start, End TimeOfDay
+	// SpeedLimit is the combined speed limit of the
+	// downloads in bytes per second, 0 means no limit.
+	SpeedLimit int64
+	// Pause stops the active downloads while the rule
+	// applies, they are resumed afterwards.
+	Pause bool
+}
+
+func (r *ScheduleRule) matches(t time.Time) bool {
+	if len(r.Days) != 0 {
+		var found bool
+		for _, day := range r.Days {
+			if day == t.Weekday() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	now := TimeOfDay(t.Hour()*60 + t.Minute())
+	switch {
+	case r.Start == r.End:
+		return true
+	case r.Start < r.End:
+		return now >= r.Start && now < r.End
+	default:
+		return now >= r.Start || now < r.End
+	}
+}
+
+// Schedule is a list of rules adjusting the downloads of the
+// Manager by the time of day, the first matching rule is
+// applied. Downloads run unlimited if no rule matches.
+type Schedule struct {
+	Rules []ScheduleRule
+}
+
+// ScheduleState is the state of the downloads at a time.
+type ScheduleState struct {
+	SpeedLimit int64
+	Paused     bool
+}
+
+// At returns the state of the downloads at t.
+func (s *Schedule) At(t time.Time) (st ScheduleState) {
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		if !r.matches(t) {
+			continue
+		}
+		st.SpeedLimit = r.SpeedLimit
+		st.Paused = r.Pause
+		return
+	}
+	return
+}
+
+// Optional fields of a schedule
+type ScheduleOpts struct {
+	// Clock tells the time to the schedule, the system
+	// clock is used if it's nil.
+	Clock Clock
+	// Interval between the evaluations of the schedule,
+	// DEF_SCHEDULE_INTERVAL is used if it's 0.
+	Interval time.Duration
+	// Client is used to resume the downloads paused by
+	// the schedule.
+	Client *http.Client
+	// ResumeOpts are used to resume the downloads paused
+	// by the schedule.
+	ResumeOpts *ResumeDownloadOpts
+	// ErrorHandler is called when a paused download fails
+	// to be resumed.
+	ErrorHandler ErrorHandlerFunc
+}
+
+func (o *ScheduleOpts) setDefault() {
+	if o.Clock == nil {
+		o.Clock = systemClock{}
+	}
+	if o.Interval == 0 {
+		o.Interval = DEF_SCHEDULE_INTERVAL
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{}
+	}
+	if o.ErrorHandler == nil {
+		o.ErrorHandler = func(string, error) {}
+	}
+}
+
+// SetSchedule makes the manager adjust its speed limit and
+// pause or resume the active downloads by the schedule s, it
+// replaces the previous schedule. A nil s removes the schedule
+// along with the limit and the pause it applied.
+func (m *Manager) SetSchedule(s *Schedule, opts *ScheduleOpts) error {
+	if m.readOnly {
+		return ErrReadOnly
+	}
+	if opts == nil {
+		opts = &ScheduleOpts{}
+	}
+	opts.setDefault()
+	m.stopSchedule()
+	if s == nil {
+		m.applySchedule(ScheduleState{}, opts)
+		return nil
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	m.smu.Lock()
+	m.sstop, m.sdone = stop, done
+	m.smu.Unlock()
+	go m.runSchedule(s, opts, stop, done)
+	return nil
+}
+
+// stopSchedule stops the running schedule and waits for it
+// to return.
+func (m *Manager) stopSchedule() {
+	m.smu.Lock()
+	stop, done := m.sstop, m.sdone
+	m.sstop, m.sdone = nil, nil
+	m.smu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (m *Manager) runSchedule(s *Schedule, opts *ScheduleOpts, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		m.applySchedule(s.At(opts.Clock.Now()), opts)
+		select {
+		case <-stop:
+			return
+		case <-opts.Clock.After(opts.Interval):
+		}
+	}
+}
+
+// applySchedule sets the speed limit of st and pauses or
+// resumes the downloads if st changes the pause. Queued items
+// aren't started while the downloads are paused.
+func (m *Manager) applySchedule(st ScheduleState, opts *ScheduleOpts) {
+	if m.GetSpeedLimit() != st.SpeedLimit {
+		m.SetSpeedLimit(st.SpeedLimit)
+	}
+	m.smu.Lock()
+	if st.Paused == m.paused {
+		m.smu.Unlock()
+		return
+	}
+	m.paused = st.Paused
+	if st.Paused {
+		m.spaused = m.pauseDownloads()
+		m.smu.Unlock()
+		return
+	}
+	paused := m.spaused
+	m.spaused = nil
+	m.smu.Unlock()
+	// resuming reaches the servers, the schedule isn't held
+	// up meanwhile.
+	m.resumeDownloads(paused, opts)
+	m.startQueued()
+}
+
+// pauseDownloads stops the running downloads, it returns the
+// ones not started by the queue to be resumed by resumeDownloads.
+func (m *Manager) pauseDownloads() (paused []string) {
+	m.mu.RLock()
+	running := make(map[string]*Downloader)
+	for hash, item := range m.items {
+		if item.State == ItemStateRunning && item.dAlloc != nil {
+			running[hash] = item.dAlloc
+		}
+	}
+	m.mu.RUnlock()
+	for hash, d := range running {
+		d.Stop()
+		// queued items are put back in the queue.
+		if m.isQueued(hash) {
+			continue
+		}
+		paused = append(paused, hash)
+	}
+	return
+}
+
+func (m *Manager) resumeDownloads(paused []string, opts *ScheduleOpts) {
+	for _, hash := range paused {
+		ropts := ResumeDownloadOpts{}
+		if opts.ResumeOpts != nil {
+			ropts = *opts.ResumeOpts
+		}
+		// handlers are copied as the downloader fills in the
+		// missing ones.
+		if ropts.Handlers != nil {
+			h := *ropts.Handlers
+			ropts.Handlers = &h
+		}
+		item, err := m.ResumeDownload(opts.Client, hash, &ropts)
+		if err != nil {
+			opts.ErrorHandler(hash, err)
+			continue
+		}
+		go func(hash string) {
+			err := item.Resume()
+			if err != nil {
+				opts.ErrorHandler(hash, err)
+			}
+		}(hash)
+	}
+}
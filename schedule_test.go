@@ -0,0 +1,202 @@
+package warplib
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    TimeOfDay
+		wantErr bool
+	}{
+		{"00:00", 0, false},
+		{"09:30", 9*60 + 30, false},
+		{"24:00", 24 * 60, false},
+		{"24:01", 0, true},
+		{"12:60", 0, true},
+		{"9:30", 0, true},
+		{"09-30", 0, true},
+		{"+1:00", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimeOfDay(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("ParseTimeOfDay(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("ParseTimeOfDay(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// officeSchedule limits the downloads during working hours
+// and pauses them on weekends.
+var officeSchedule = &Schedule{Rules: []ScheduleRule{
+	{Days: []time.Weekday{time.Saturday, time.Sunday}, Pause: true},
+	{Start: 9 * 60, End: 18 * 60, SpeedLimit: 2 * MB},
+}}
+
+func TestSchedule_At(t *testing.T) {
+	night := &Schedule{Rules: []ScheduleRule{{Start: 22 * 60, End: 6 * 60, SpeedLimit: MB}}}
+	// 2024-01-01 is a Monday.
+	at := func(day, h, m int) time.Time {
+		return time.Date(2024, time.January, day, h, m, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		s    *Schedule
+		t    time.Time
+		want ScheduleState
+	}{
+		{"before working hours", officeSchedule, at(1, 8, 59), ScheduleState{}},
+		{"working hours start", officeSchedule, at(1, 9, 0), ScheduleState{SpeedLimit: 2 * MB}},
+		{"working hours", officeSchedule, at(3, 17, 59), ScheduleState{SpeedLimit: 2 * MB}},
+		{"working hours end", officeSchedule, at(5, 18, 0), ScheduleState{}},
+		{"saturday", officeSchedule, at(6, 12, 0), ScheduleState{Paused: true}},
+		{"sunday night", officeSchedule, at(7, 23, 59), ScheduleState{Paused: true}},
+		{"before midnight", night, at(1, 23, 0), ScheduleState{SpeedLimit: MB}},
+		{"after midnight", night, at(2, 5, 59), ScheduleState{SpeedLimit: MB}},
+		{"morning", night, at(2, 6, 0), ScheduleState{}},
+		{"no rules", &Schedule{}, at(1, 12, 0), ScheduleState{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.At(tt.t); got != tt.want {
+				t.Errorf("At() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeClock hands the channels returned by After to the test
+// through ticks, so that the test can advance the schedule.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	ticks chan chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.ticks <- ch
+	return ch
+}
+
+func (c *fakeClock) advance(tick chan time.Time, d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+	tick <- c.now
+}
+
+func TestManager_SetSchedule(t *testing.T) {
+	m, err := NewManager(&Config{ConfigDir: t.TempDir()}, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{
+		now:   time.Date(2024, time.January, 1, 8, 0, 0, 0, time.UTC),
+		ticks: make(chan chan time.Time),
+	}
+	m.SetSchedule(officeSchedule, &ScheduleOpts{Clock: clock})
+	tick := <-clock.ticks
+	if got := m.GetSpeedLimit(); got != 0 {
+		t.Errorf("GetSpeedLimit() = %d before working hours, want 0", got)
+	}
+	steps := []struct {
+		advance   time.Duration
+		wantLimit int64
+	}{
+		{time.Hour, 2 * MB},
+		{8 * time.Hour, 2 * MB},
+		{time.Hour, 0},
+	}
+	for _, step := range steps {
+		clock.advance(tick, step.advance)
+		tick = <-clock.ticks
+		if got := m.GetSpeedLimit(); got != step.wantLimit {
+			t.Errorf("at %s: GetSpeedLimit() = %d, want %d", clock.Now().Format("15:04"), got, step.wantLimit)
+		}
+	}
+	m.SetSchedule(nil, nil)
+	if got := m.GetSpeedLimit(); got != 0 {
+		t.Errorf("GetSpeedLimit() = %d after removing the schedule, want 0", got)
+	}
+}
+
+// TestManager_pauseDownloads pauses a running download next to
+// one which was never started, only the running one is stopped
+// and resumed by the schedule.
+func TestManager_pauseDownloads(t *testing.T) {
+	data := bytes.Repeat([]byte("warp"), int(MB)/2)
+	srv := newRangeServer(t, data, 5*time.Millisecond)
+	cfg := &Config{ConfigDir: t.TempDir()}
+	m, err := NewManager(cfg, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	progress := make(chan struct{}, 1)
+	var ds []*Downloader
+	for i := 0; i < 2; i++ {
+		d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+			Config:            cfg,
+			DownloadDirectory: t.TempDir(),
+			Handlers: &Handlers{
+				DownloadProgressHandler: func(string, int) {
+					select {
+					case progress <- struct{}{}:
+					default:
+					}
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = m.AddDownload(d, nil); err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	running, idle := ds[0], ds[1]
+	started := make(chan error, 1)
+	go func() { started <- running.Start() }()
+	<-progress
+	opts := &ScheduleOpts{}
+	opts.setDefault()
+	m.applySchedule(ScheduleState{Paused: true}, opts)
+	if err = <-started; err != nil {
+		t.Fatal(err)
+	}
+	if idle.IsStopped() {
+		t.Error("download which wasn't started was stopped")
+	}
+	if want := []string{running.hash}; !reflect.DeepEqual(m.spaused, want) {
+		t.Errorf("paused downloads = %v, want %v", m.spaused, want)
+	}
+	item := m.GetItem(running.hash)
+	m.applySchedule(ScheduleState{}, opts)
+	deadline := time.Now().Add(5 * time.Second)
+	for item.GetState() != ItemStateCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("resumed item is %s, want %s", item.GetState(), ItemStateCompleted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := m.GetItem(idle.hash).GetState(); s != ItemStatePending {
+		t.Errorf("item which wasn't started is %s, want %s", s, ItemStatePending)
+	}
+}
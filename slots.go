@@ -0,0 +1,46 @@
+package warplib
+
+import "sync/atomic"
+
+// slots counts the connections or the parts of a download in
+// use against a limit, 0 meaning no limit. It's safe for use
+// by the goroutines of the parts.
+type slots struct {
+	n, max atomic.Int64
+}
+
+// tryAcquire takes a slot if one is free, it reports whether a
+// slot was taken.
+func (s *slots) tryAcquire() bool {
+	for {
+		n, max := s.n.Load(), s.max.Load()
+		if max != 0 && n >= max {
+			return false
+		}
+		if s.n.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// acquire takes a slot regardless of the limit.
+func (s *slots) acquire() {
+	s.n.Add(1)
+}
+
+// release frees a slot taken by acquire or tryAcquire.
+func (s *slots) release() {
+	s.n.Add(-1)
+}
+
+func (s *slots) count() int {
+	return int(s.n.Load())
+}
+
+func (s *slots) limit() int {
+	return int(s.max.Load())
+}
+
+func (s *slots) setLimit(max int) {
+	s.max.Store(int64(max))
+}
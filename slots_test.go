@@ -0,0 +1,35 @@
+package warplib
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSlots_tryAcquire(t *testing.T) {
+	var s slots
+	s.setLimit(4)
+	var taken atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.tryAcquire() {
+				taken.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if taken.Load() != 4 || s.count() != 4 {
+		t.Fatalf("took %d slots, count() = %d, want 4", taken.Load(), s.count())
+	}
+	s.release()
+	if !s.tryAcquire() {
+		t.Errorf("released slot can't be taken again")
+	}
+	s.acquire()
+	if s.count() != 5 {
+		t.Errorf("count() = %d after acquire past the limit, want 5", s.count())
+	}
+}
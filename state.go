@@ -0,0 +1,139 @@
+package warplib
+
+import (
+	"fmt"
+	"time"
+)
+
+// ItemState is the lifecycle state of a download item.
+type ItemState string
+
+const (
+	// ItemStatePending is the state of an item that has been
+	// added but not started yet.
+	ItemStatePending ItemState = "pending"
+	// ItemStateQueued is the state of an item waiting in the
+	// queue of the manager.
+	ItemStateQueued ItemState = "queued"
+	// ItemStateRunning is the state of an item being downloaded.
+	ItemStateRunning ItemState = "running"
+	// ItemStatePaused is the state of a stopped item which can
+	// be resumed.
+	ItemStatePaused ItemState = "paused"
+	// ItemStateVerifying is the state of an item whose bytes are
+	// all downloaded and which is being verified against its
+	// checksums.
+	ItemStateVerifying ItemState = "verifying"
+	// ItemStateFailed is the state of an item which stopped due
+	// to an error, see Item.LastError.
+	ItemStateFailed ItemState = "failed"
+	// ItemStateCompleted is the state of a downloaded item.
+	ItemStateCompleted ItemState = "completed"
+)
+
+// itemTransitions maps the states of an item to the states
+// it can move to.
+var itemTransitions = map[ItemState][]ItemState{
+	ItemStatePending: {
+		ItemStateQueued, ItemStateRunning, ItemStateFailed,
+	},
+	ItemStateQueued: {
+		ItemStatePending, ItemStateRunning, ItemStatePaused, ItemStateFailed,
+	},
+	ItemStateRunning: {
+		ItemStatePaused, ItemStateVerifying, ItemStateFailed, ItemStateCompleted,
+	},
+	ItemStatePaused: {
+		ItemStateQueued, ItemStateRunning, ItemStateFailed,
+	},
+	ItemStateVerifying: {
+		ItemStateFailed, ItemStateCompleted,
+	},
+	ItemStateFailed: {
+		ItemStateQueued, ItemStateRunning,
+	},
+	ItemStateCompleted: {},
+}
+
+// canTransition reports whether an item can move from the
+// state from to the state to.
+func canTransition(from, to ItemState) bool {
+	for _, s := range itemTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setState moves the item to the state s, err is recorded as
+// the last error of the item if it's not nil. Moving an item
+// to its current state is a no-op, the onState hook of the item
+// is called otherwise.
+func (i *Item) setState(s ItemState, err error) error {
+	i.mu.Lock()
+	if i.State == s {
+		i.mu.Unlock()
+		return nil
+	}
+	if er := i.checkTransition(s); er != nil {
+		i.mu.Unlock()
+		return er
+	}
+	i.changeState(s, err)
+	onState := i.onState
+	i.mu.Unlock()
+	if onState != nil {
+		onState(i.Hash, s, err)
+	}
+	return nil
+}
+
+// checkTransition returns ErrInvalidTransition if the item can't
+// move to the state s, the item has to be locked.
+func (i *Item) checkTransition(s ItemState) error {
+	if i.State != s && !canTransition(i.State, s) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, i.State, s)
+	}
+	return nil
+}
+
+// changeState sets the state s, the item has to be locked.
+func (i *Item) changeState(s ItemState, err error) {
+	i.State = s
+	if err != nil {
+		i.LastError = err.Error()
+	}
+	now := time.Now()
+	switch s {
+	case ItemStateRunning:
+		if i.StartedAt.IsZero() {
+			i.StartedAt = now
+		}
+	case ItemStateFailed, ItemStateCompleted:
+		i.FinishedAt = now
+	}
+}
+
+// GetState returns the lifecycle state of the item.
+func (i *Item) GetState() ItemState {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.State
+}
+
+// migrateState sets the state of an item saved before items
+// had states.
+func (i *Item) migrateState() {
+	if i.State != "" {
+		return
+	}
+	switch {
+	case i.TotalSize == i.Downloaded && len(i.Parts) == 0:
+		i.State = ItemStateCompleted
+	case i.Downloaded != 0:
+		i.State = ItemStatePaused
+	default:
+		i.State = ItemStatePending
+	}
+}
@@ -0,0 +1,68 @@
+package warplib
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestItem_setState(t *testing.T) {
+	i := &Item{State: ItemStatePending, mu: new(sync.RWMutex)}
+	steps := []struct {
+		to      ItemState
+		err     error
+		wantErr error
+	}{
+		{ItemStateQueued, nil, nil},
+		{ItemStateRunning, nil, nil},
+		{ItemStateRunning, nil, nil},
+		{ItemStatePending, nil, ErrInvalidTransition},
+		{ItemStateFailed, errors.New("connection reset"), nil},
+		{ItemStateRunning, nil, nil},
+		{ItemStateVerifying, nil, nil},
+		{ItemStatePaused, nil, ErrInvalidTransition},
+		{ItemStateCompleted, nil, nil},
+		{ItemStateQueued, nil, ErrInvalidTransition},
+	}
+	for _, step := range steps {
+		from := i.State
+		err := i.setState(step.to, step.err)
+		if !errors.Is(err, step.wantErr) {
+			t.Fatalf("setState(%s) from %s error = %v, want %v", step.to, from, err, step.wantErr)
+		}
+		want := step.to
+		if err != nil {
+			want = from
+		}
+		if i.State != want {
+			t.Fatalf("setState(%s) from %s: State = %s, want %s", step.to, from, i.State, want)
+		}
+	}
+	if i.LastError != "connection reset" {
+		t.Errorf("LastError = %q, want %q", i.LastError, "connection reset")
+	}
+	if i.StartedAt.IsZero() || i.FinishedAt.Before(i.StartedAt) {
+		t.Errorf("StartedAt = %v, FinishedAt = %v", i.StartedAt, i.FinishedAt)
+	}
+}
+
+func TestItem_migrateState(t *testing.T) {
+	tests := []struct {
+		name string
+		item *Item
+		want ItemState
+	}{
+		{"completed", &Item{TotalSize: 10, Downloaded: 10}, ItemStateCompleted},
+		{"partially downloaded", &Item{TotalSize: 10, Downloaded: 5, Parts: map[int64]*ItemPart{0: {}}}, ItemStatePaused},
+		{"not started", &Item{TotalSize: 10}, ItemStatePending},
+		{"already set", &Item{TotalSize: 10, State: ItemStateFailed}, ItemStateFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.item.migrateState()
+			if tt.item.State != tt.want {
+				t.Errorf("migrateState() State = %s, want %s", tt.item.State, tt.want)
+			}
+		})
+	}
+}
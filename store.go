@@ -0,0 +1,191 @@
+package warplib
+
+import (
+	"os"
+	"sync"
+)
+
+// Store persists the items of a Manager. The manager keeps its
+// items in memory and writes every change through the store.
+type Store interface {
+	// Load returns the items saved in the store, it's called
+	// once by the manager.
+	Load() (ItemsMap, error)
+	// Put saves the item, replacing the item with the same
+	// hash if there is one.
+	Put(item *Item) error
+	// Delete removes the item with hash, it's a no-op if the
+	// item doesn't exist.
+	Delete(hash string) error
+	// List returns the items saved in the store.
+	List() ([]*Item, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// readOnlyStore is implemented by the stores which can be
+// opened read-only.
+type readOnlyStore interface {
+	ReadOnly() bool
+}
+
+// isReadOnly reports whether store refuses changes.
+func isReadOnly(store Store) bool {
+	ro, ok := store.(readOnlyStore)
+	return ok && ro.ReadOnly()
+}
+
+// FileStore is a Store saving the items in a single gob encoded
+// database file, which is replaced atomically on every change.
+// Loading the store locks the database until the store is
+// closed so that only one process writes to it.
+type FileStore struct {
+	path     string
+	readOnly bool
+	closed   bool
+	mu       sync.Mutex
+	lock     *os.File
+	items    ItemsMap
+}
+
+// NewFileStore creates a FileStore saving the items to the
+// file at path.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, items: make(ItemsMap)}
+}
+
+// NewReadOnlyFileStore creates a FileStore reading the items
+// from the file at path without locking it, it refuses changes
+// with ErrReadOnly.
+func NewReadOnlyFileStore(path string) *FileStore {
+	s := NewFileStore(path)
+	s.readOnly = true
+	return s
+}
+
+func (s *FileStore) Load() (items ItemsMap, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.readOnly && s.lock == nil {
+		s.lock, err = acquireLock(s.path)
+		if err != nil {
+			return
+		}
+	}
+	items, err = loadDB(s.path)
+	if err != nil {
+		releaseLock(s.lock)
+		s.lock = nil
+		return
+	}
+	s.items = make(ItemsMap, len(items))
+	for hash, item := range items {
+		s.items[hash] = item
+	}
+	return
+}
+
+func (s *FileStore) Put(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	// another process may hold the lock once it's released.
+	if s.closed {
+		return os.ErrClosed
+	}
+	s.items[item.Hash] = item
+	return saveDB(s.path, s.items)
+}
+
+func (s *FileStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	// another process may hold the lock once it's released.
+	if s.closed {
+		return os.ErrClosed
+	}
+	if _, ok := s.items[hash]; !ok {
+		return nil
+	}
+	delete(s.items, hash)
+	return saveDB(s.path, s.items)
+}
+
+func (s *FileStore) List() ([]*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listItems(s.items), nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	err := releaseLock(s.lock)
+	s.lock = nil
+	return err
+}
+
+// ReadOnly reports whether the store was opened read-only.
+func (s *FileStore) ReadOnly() bool {
+	return s.readOnly
+}
+
+// MemoryStore is a Store keeping the items in memory only,
+// it's meant for tests and short-lived managers.
+type MemoryStore struct {
+	mu    sync.Mutex
+	items ItemsMap
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{items: make(ItemsMap)}
+}
+
+func (s *MemoryStore) Load() (ItemsMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make(ItemsMap, len(s.items))
+	for hash, item := range s.items {
+		items[hash] = item
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) Put(item *Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[item.Hash] = item
+	return nil
+}
+
+func (s *MemoryStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, hash)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return listItems(s.items), nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func listItems(items ItemsMap) []*Item {
+	list := make([]*Item, 0, len(items))
+	for _, item := range items {
+		list = append(list, item)
+	}
+	return list
+}
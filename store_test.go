@@ -0,0 +1,122 @@
+package warplib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	mem := NewMemoryStore()
+	stores := []struct {
+		name string
+		open func() Store
+	}{
+		{"file", func() Store { return NewFileStore(filepath.Join(dir, "userdata.warp")) }},
+		{"jsonl", func() Store { return NewJSONLStore(filepath.Join(dir, "userdata.jsonl")) }},
+		{"memory", func() Store { return mem }},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			s := st.open()
+			items, err := s.Load()
+			if err != nil || len(items) != 0 {
+				t.Fatalf("Load() of new store = %v, %v", items, err)
+			}
+			for _, item := range testItems() {
+				if err = s.Put(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+			updated := &Item{Hash: "b", TotalSize: 10, Downloaded: 10, State: ItemStateCompleted}
+			if err = s.Put(updated); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.Delete("missing"); err != nil {
+				t.Fatalf("Delete() of missing item error = %v", err)
+			}
+			list, err := s.List()
+			if err != nil || len(list) != 1 || list[0].Hash != "b" {
+				t.Fatalf("List() = %v, %v, want item b", list, err)
+			}
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s = st.open()
+			items, err = s.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if len(items) != 1 || items["b"] == nil || items["b"].State != ItemStateCompleted {
+				t.Errorf("Load() after reopening = %v, want completed item b", items)
+			}
+		})
+	}
+}
+
+func Test_decodeJSONL(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantItems []string
+		wantErr   error
+	}{
+		{"empty", "", nil, nil},
+		{"puts and deletes", "{\"version\":1}\n{\"put\":{\"Hash\":\"a\"}}\n{\"put\":{\"Hash\":\"b\"}}\n{\"delete\":\"a\"}\n", []string{"b"}, nil},
+		{"torn last line", "{\"version\":1}\n{\"put\":{\"Hash\":\"a\"}}\n{\"put\":{\"Ha", []string{"a"}, nil},
+		{"corrupt line", "{\"version\":1}\n{\"put\":{\"Ha\n{\"put\":{\"Hash\":\"a\"}}\n", nil, ErrDatabaseCorrupt},
+		{"missing version", "{\"put\":{\"Hash\":\"a\"}}\n", nil, ErrDatabaseCorrupt},
+		{"newer version", "{\"version\":99}\n", nil, ErrDatabaseVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := decodeJSONL([]byte(tt.data))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decodeJSONL() error = %v, want %v", err, tt.wantErr)
+			}
+			var got []string
+			for hash := range items {
+				got = append(got, hash)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.wantItems) {
+				t.Fatalf("decodeJSONL() items = %v, want %v", got, tt.wantItems)
+			}
+			for i := range got {
+				if got[i] != tt.wantItems[i] {
+					t.Fatalf("decodeJSONL() items = %v, want %v", got, tt.wantItems)
+				}
+			}
+		})
+	}
+}
+
+func TestJSONLStore_compact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "userdata.jsonl")
+	s := NewJSONLStore(path)
+	if _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	item := &Item{Hash: "a", TotalSize: 10}
+	for i := 0; i < 2*_JSONL_COMPACT_MIN; i++ {
+		item.Downloaded = ContentLength(i % 10)
+		if err := s.Put(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.records > _JSONL_COMPACT_MIN+1 {
+		t.Errorf("log holds %d records after compaction", s.records)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() > 64*KB {
+		t.Errorf("log size = %v, %v", fi, err)
+	}
+}
@@ -0,0 +1,52 @@
+package warplib
+
+import (
+	"net/http"
+	"strings"
+)
+
+// validator identifies the version of the remote file by the
+// ETag and Last-Modified headers sent by the server.
+type validator struct {
+	etag         string
+	lastModified string
+}
+
+func newValidator(h http.Header) validator {
+	return validator{
+		etag:         h.Get("ETag"),
+		lastModified: h.Get("Last-Modified"),
+	}
+}
+
+func (v validator) empty() bool {
+	return v.etag == "" && v.lastModified == ""
+}
+
+// ifRange returns the value for an If-Range header, weak
+// ETags can't be used for it.
+func (v validator) ifRange() string {
+	if v.etag != "" && !strings.HasPrefix(v.etag, "W/") {
+		return v.etag
+	}
+	return v.lastModified
+}
+
+// changed reports whether resp belongs to a different version
+// of the remote file. ifRange tells if the request of a range
+// past the start of the file was sent with an If-Range header,
+// for which servers send the whole new file instead of the
+// range once the file changes.
+func (v validator) changed(resp *http.Response, ifRange bool) bool {
+	if ifRange && resp.StatusCode == http.StatusOK {
+		return true
+	}
+	nv := newValidator(resp.Header)
+	if v.etag != "" && nv.etag != "" {
+		return strings.TrimPrefix(v.etag, "W/") != strings.TrimPrefix(nv.etag, "W/")
+	}
+	if v.lastModified != "" && nv.lastModified != "" {
+		return v.lastModified != nv.lastModified
+	}
+	return false
+}
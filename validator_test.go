@@ -0,0 +1,104 @@
+package warplib
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func Test_validator_ifRange(t *testing.T) {
+	tests := []struct {
+		name string
+		v    validator
+		want string
+	}{
+		{"strong etag", validator{`"abc"`, "Mon, 02 Jan 2006 15:04:05 GMT"}, `"abc"`},
+		{"weak etag", validator{`W/"abc"`, "Mon, 02 Jan 2006 15:04:05 GMT"}, "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{"last modified only", validator{"", "Mon, 02 Jan 2006 15:04:05 GMT"}, "Mon, 02 Jan 2006 15:04:05 GMT"},
+		{"empty", validator{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.v.ifRange(); got != tt.want {
+				t.Errorf("ifRange() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validator_changed(t *testing.T) {
+	const (
+		lm1 = "Mon, 02 Jan 2006 15:04:05 GMT"
+		lm2 = "Tue, 03 Jan 2006 15:04:05 GMT"
+	)
+	tests := []struct {
+		name    string
+		v       validator
+		status  int
+		header  http.Header
+		ifRange bool
+		want    bool
+	}{
+		{"same etag", validator{`"a"`, ""}, http.StatusPartialContent, http.Header{"Etag": {`"a"`}}, true, false},
+		{"different etag", validator{`"a"`, ""}, http.StatusPartialContent, http.Header{"Etag": {`"b"`}}, false, true},
+		{"weak etag", validator{`W/"a"`, ""}, http.StatusPartialContent, http.Header{"Etag": {`"a"`}}, false, false},
+		{"etag preferred", validator{`"a"`, lm1}, http.StatusPartialContent, http.Header{"Etag": {`"a"`}, "Last-Modified": {lm2}}, false, false},
+		{"different last modified", validator{"", lm1}, http.StatusPartialContent, http.Header{"Last-Modified": {lm2}}, false, true},
+		{"full content for if-range", validator{`"a"`, ""}, http.StatusOK, http.Header{"Etag": {`"a"`}}, true, true},
+		{"full content without if-range", validator{`"a"`, ""}, http.StatusOK, http.Header{"Etag": {`"a"`}}, false, false},
+		{"no validators sent", validator{`"a"`, lm1}, http.StatusPartialContent, http.Header{}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: tt.header}
+			if got := tt.v.changed(resp, tt.ifRange); got != tt.want {
+				t.Errorf("changed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDownloader_noRangeETag downloads from a server ignoring ranges
+// and sending an ETag, its whole file responses mustn't be taken
+// for a change of the file.
+func TestDownloader_noRangeETag(t *testing.T) {
+	data := bytes.Repeat([]byte("warp"), 64*1024)
+	var ifRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Range") != "" {
+			ifRange = true
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer srv.Close()
+	d, err := NewDownloader(&http.Client{}, srv.URL+"/file.bin", &DownloaderOpts{
+		Config:            &Config{ConfigDir: t.TempDir()},
+		DownloadDirectory: t.TempDir(),
+		MaxConnections:    4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.noRange {
+		t.Fatal("server ignoring ranges wasn't detected")
+	}
+	if err = d.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if ifRange {
+		t.Error("If-Range was sent to a server ignoring ranges")
+	}
+	got, err := os.ReadFile(d.GetSavePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded file differs from the served one")
+	}
+}
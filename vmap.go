@@ -16,6 +16,8 @@ func NewVMap[kT comparable, vT any]() VMap[kT, vT] {
 }
 
 func (vm *VMap[kT, vT]) Make() {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
 	vm.kv = make(map[kT]vT)
 }
 
@@ -25,6 +27,12 @@ func (vm *VMap[kT, vT]) Set(key kT, val vT) {
 	vm.kv[key] = val
 }
 
+func (vm *VMap[kT, vT]) Delete(key kT) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	delete(vm.kv, key)
+}
+
 func (vm *VMap[kT, vT]) GetUnsafe(key kT) (val vT) {
 	val = vm.kv[key]
 	return
@@ -38,14 +46,13 @@ func (vm *VMap[kT, vT]) Get(key kT) (val vT) {
 }
 
 func (vm *VMap[kT, vT]) Dump() (keys []kT, vals []vT) {
-	n := len(vm.kv)
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
 
+	n := len(vm.kv)
 	keys = make([]kT, n)
 	vals = make([]vT, n)
 
-	vm.mu.Lock()
-	defer vm.mu.Unlock()
-
 	var i int
 	for key, val := range vm.kv {
 		keys[i] = key
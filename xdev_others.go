@@ -0,0 +1,9 @@
+//go:build !windows
+
+package warplib
+
+import "syscall"
+
+// errCrossDevice is returned by os.Rename when the file is
+// moved to a different filesystem.
+const errCrossDevice = syscall.EXDEV
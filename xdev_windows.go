@@ -0,0 +1,7 @@
+package warplib
+
+import "syscall"
+
+// errCrossDevice is returned by os.Rename when the file is
+// moved to a different disk drive (ERROR_NOT_SAME_DEVICE).
+const errCrossDevice = syscall.Errno(17)